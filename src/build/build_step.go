@@ -42,6 +42,7 @@ func Build(tid int, state *core.BuildState, label core.BuildLabel) {
 	target := state.Graph.TargetOrDie(label)
 	state = state.ForTarget(target)
 	target.SetState(core.Building)
+	metrics.RecordStart(target, false)
 	if err := buildTarget(tid, state, target); err != nil {
 		if err == errStop {
 			target.SetState(core.Stopped)
@@ -178,6 +179,7 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 		return false
 	}
 	cacheKey := mustShortTargetHash(state, target)
+	metrics.RecordCacheKey(target, cacheKey)
 	if state.Cache != nil {
 		// Note that ordering here is quite sensitive since the post-build function can modify
 		// what we would retrieve from the cache.
@@ -261,11 +263,20 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 // On success it returns the stdout of the target, otherwise an error.
 func runBuildCommand(state *core.BuildState, target *core.BuildTarget, command string, inputHash []byte) ([]byte, error) {
 	if target.IsRemoteFile {
-		return nil, fetchRemoteFile(state, target)
+		err := fetchRemoteFile(state, target)
+		if err == nil {
+			metrics.RecordRemoteFetch(remoteFetchKind(state, target))
+		}
+		return nil, err
 	}
 	env := core.StampedBuildEnvironment(state, target, inputHash)
 	log.Debug("Building target %s\nENVIRONMENT:\n%s\n%s", target.Label, env, command)
+	cpuTime, readBytes, writeBytes := target.CPUTime, target.IOReadBytes, target.IOWriteBytes
 	out, combined, err := core.ExecWithTimeoutShell(state, target, target.TmpDir(), env, target.BuildTimeout, state.Config.Build.Timeout, state.ShowAllOutput, command, target.Sandbox)
+	metrics.RecordCPU(target, (target.CPUTime - cpuTime).Seconds())
+	if core.IOStatsAvailable {
+		metrics.RecordIO(target, target.IOReadBytes-readBytes, target.IOWriteBytes-writeBytes)
+	}
 	if err != nil {
 		if state.Verbosity >= 4 {
 			return nil, fmt.Errorf("Error building target %s: %s\nENVIRONMENT:\n%s\n%s\n%s",
@@ -273,9 +284,37 @@ func runBuildCommand(state *core.BuildState, target *core.BuildTarget, command s
 		}
 		return nil, fmt.Errorf("Error building target %s: %s\n%s", target.Label, err, combined)
 	}
+	if kind := remoteFetchKind(state, target); kind != "" {
+		metrics.RecordRemoteFetch(kind)
+	}
 	return out, nil
 }
 
+// remoteFetchKind returns the kind of third-party dependency that the given target downloads
+// when it's built, or the empty string if it isn't one that we know about.
+// The labels for maven_jar & pip_library are on the parent rule, so we only count the subrules
+// that do the actual downloading, not the others (e.g. extracting classes.jar from an .aar).
+func remoteFetchKind(state *core.BuildState, target *core.BuildTarget) string {
+	var parent *core.BuildTarget
+	if target.Label.HasParent() {
+		parent = state.Graph.Target(target.Label.Parent())
+	}
+	hasParentLabel := func(prefix string) bool {
+		return parent != nil && len(parent.PrefixedLabels(prefix)) > 0
+	}
+	isWheel := target.IsRemoteFile || strings.HasSuffix(target.Label.Name, "#wheel")
+	if len(target.PrefixedLabels("go_get:")) > 0 {
+		return "go_mod"
+	} else if target.IsRemoteFile && hasParentLabel("mvn:") {
+		return "maven"
+	} else if isWheel && (hasParentLabel("pip:") || hasParentLabel("whl:")) {
+		return "pip"
+	} else if target.IsRemoteFile {
+		return "http"
+	}
+	return ""
+}
+
 // Prepares the output directories for a target
 func prepareDirectories(target *core.BuildTarget) error {
 	if err := prepareDirectory(target.TmpDir(), true); err != nil {
@@ -510,6 +549,7 @@ func checkRuleHashes(target *core.BuildTarget, hash []byte) error {
 			return nil
 		}
 	}
+	metrics.RecordHashMismatch(target)
 	if len(target.Hashes) == 1 {
 		return fmt.Errorf("Bad output hash for rule %s: was %s but expected %s",
 			target.Label, hashStr, target.Hashes[0])
@@ -520,7 +560,13 @@ func checkRuleHashes(target *core.BuildTarget, hash []byte) error {
 
 func retrieveFromCache(state *core.BuildState, target *core.BuildTarget) ([]byte, bool) {
 	hash := mustShortTargetHash(state, target)
-	return hash, state.Cache.Retrieve(target, hash)
+	if !state.Cache.Retrieve(target, hash) {
+		metrics.RecordCacheEntries(target, 0)
+		metrics.RecordCacheMiss(target, hash)
+		return hash, false
+	}
+	metrics.RecordCacheEntries(target, len(target.Outputs()))
+	return hash, true
 }
 
 // Runs the post-build function for a target if it's got one.
@@ -221,6 +221,44 @@ func TestLicenceEnforcement(t *testing.T) {
 	}, "Trying to add GPL should panic (case insensitive)")
 }
 
+func TestRemoteFetchKind(t *testing.T) {
+	state, target := newState("//pkg:plain")
+	assert.Equal(t, "", remoteFetchKind(state, target))
+
+	target = core.NewBuildTarget(core.ParseBuildLabel("//third_party/go:_mux#get", ""))
+	target.AddLabel("go_get:github.com/gorilla/mux")
+	assert.Equal(t, "go_mod", remoteFetchKind(state, target))
+
+	parent := core.NewBuildTarget(core.ParseBuildLabel("//third_party/java:guava", ""))
+	parent.AddLabel("mvn:com.google.guava:guava:22.0")
+	state.Graph.AddTarget(parent)
+	target = core.NewBuildTarget(core.ParseBuildLabel("//third_party/java:_guava#bin", ""))
+	target.IsRemoteFile = true
+	assert.Equal(t, "maven", remoteFetchKind(state, target))
+	assert.Equal(t, "", remoteFetchKind(state, parent), "Only the subrule actually downloads anything")
+	target = core.NewBuildTarget(core.ParseBuildLabel("//third_party/java:_guava#classes", ""))
+	assert.Equal(t, "", remoteFetchKind(state, target), "Other subrules don't download anything")
+
+	parent = core.NewBuildTarget(core.ParseBuildLabel("//third_party/python:six", ""))
+	parent.AddLabel("pip:six")
+	state.Graph.AddTarget(parent)
+	target = core.NewBuildTarget(core.ParseBuildLabel("//third_party/python:_six#wheel", ""))
+	assert.Equal(t, "pip", remoteFetchKind(state, target))
+	target = core.NewBuildTarget(core.ParseBuildLabel("//third_party/python:_six#patch", ""))
+	assert.Equal(t, "", remoteFetchKind(state, target))
+
+	parent = core.NewBuildTarget(core.ParseBuildLabel("//third_party/python:numpy", ""))
+	parent.AddLabel("whl:numpy==1.14.0")
+	state.Graph.AddTarget(parent)
+	target = core.NewBuildTarget(core.ParseBuildLabel("//third_party/python:_numpy#1", ""))
+	target.IsRemoteFile = true
+	assert.Equal(t, "pip", remoteFetchKind(state, target))
+
+	target = core.NewBuildTarget(core.ParseBuildLabel("//third_party:file", ""))
+	target.IsRemoteFile = true
+	assert.Equal(t, "http", remoteFetchKind(state, target))
+}
+
 func newState(label string) (*core.BuildState, *core.BuildTarget) {
 	config, _ := core.ReadConfigFiles(nil, "")
 	state := core.NewBuildState(1, nil, 4, config)
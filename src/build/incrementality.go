@@ -48,17 +48,22 @@ var boolFalseHashValue = []byte{1}
 func needsBuilding(state *core.BuildState, target *core.BuildTarget, postBuild bool) bool {
 	// Check the dependencies first, because they don't need any disk I/O.
 	if target.NeedsTransitiveDependencies {
-		if anyDependencyHasChanged(target) {
+		if dep := changedDependency(target); dep != nil {
+			setDependencyInvalidation(target, dep)
 			return true // one of the transitive deps has changed, need to rebuild
 		}
 	} else {
 		for _, dep := range target.Dependencies() {
 			if dep.State() < core.Unchanged {
 				log.Debug("Need to rebuild %s, %s has changed", target.Label, dep.Label)
+				setDependencyInvalidation(target, dep)
 				return true // dependency has just been rebuilt, do this too.
 			}
 		}
 	}
+	// Anything past here is down to the target itself, unless the config has changed.
+	target.InvalidationReason = core.InvalidatedBySelf
+	target.RebuildTrigger = core.TriggeredByUnknown
 	oldRuleHash, oldConfigHash, oldSourceHash, oldSecretHash := readRuleHashFile(ruleHashFileName(target), postBuild)
 	if !bytes.Equal(oldConfigHash, state.Hashes.Config) {
 		if len(oldConfigHash) == 0 {
@@ -66,22 +71,27 @@ func needsBuilding(state *core.BuildState, target *core.BuildTarget, postBuild b
 			log.Debug("Need to build %s, outputs aren't there", target.Label)
 		} else {
 			log.Debug("Need to rebuild %s, config has changed (was %s, need %s)", target.Label, b64(oldConfigHash), b64(state.Hashes.Config))
+			target.InvalidationReason = core.InvalidatedByConfig
+			target.RebuildTrigger = core.TriggeredByConfig
 		}
 		return true
 	}
 	newRuleHash := RuleHash(state, target, false, postBuild)
 	if !bytes.Equal(oldRuleHash, newRuleHash) {
 		log.Debug("Need to rebuild %s, rule has changed (was %s, need %s)", target.Label, b64(oldRuleHash), b64(newRuleHash))
+		target.RebuildTrigger = core.TriggeredByBuildFile
 		return true
 	}
 	newSourceHash, err := sourceHash(state, target)
 	if err != nil || !bytes.Equal(oldSourceHash, newSourceHash) {
 		log.Debug("Need to rebuild %s, sources have changed (was %s, need %s)", target.Label, b64(oldSourceHash), b64(newSourceHash))
+		target.RebuildTrigger = core.TriggeredBySource
 		return true
 	}
 	newSecretHash, err := secretHash(state, target)
 	if err != nil || !bytes.Equal(oldSecretHash, newSecretHash) {
 		log.Debug("Need to rebuild %s, secrets have changed (was %s, need %s)", target.Label, b64(oldSecretHash), b64(newSecretHash))
+		target.RebuildTrigger = core.TriggeredBySource
 		return true
 	}
 
@@ -107,15 +117,28 @@ func b64(b []byte) string {
 	return base64.RawStdEncoding.EncodeToString(b)
 }
 
-// Returns true if any transitive dependency of this target has changed.
-func anyDependencyHasChanged(target *core.BuildTarget) bool {
-	done := map[core.BuildLabel]bool{}
+// setDependencyInvalidation records the reason and trigger when a target is being rebuilt
+// because the given direct dependency of it (or something beneath that) has changed.
+func setDependencyInvalidation(target, dep *core.BuildTarget) {
+	if target.IsTool(dep.Label) {
+		target.InvalidationReason = core.InvalidatedByTool
+		target.RebuildTrigger = core.TriggeredByTool
+	} else {
+		target.InvalidationReason = core.InvalidatedByDependency
+		target.RebuildTrigger = core.TriggeredBySource
+	}
+}
+
+// changedDependency returns the direct dependency of this target through which some transitive
+// dependency has changed, or nil if none of them have.
+func changedDependency(target *core.BuildTarget) *core.BuildTarget {
+	done := map[core.BuildLabel]bool{target.Label: true}
 	var inner func(*core.BuildTarget) bool
 	inner = func(dependency *core.BuildTarget) bool {
 		done[dependency.Label] = true
-		if dependency != target && dependency.State() < core.Unchanged {
+		if dependency.State() < core.Unchanged {
 			return true
-		} else if !dependency.OutputIsComplete || dependency == target {
+		} else if !dependency.OutputIsComplete {
 			for _, dep := range dependency.Dependencies() {
 				if !done[dep.Label] {
 					if inner(dep) {
@@ -127,7 +150,13 @@ func anyDependencyHasChanged(target *core.BuildTarget) bool {
 		}
 		return false
 	}
-	return inner(target)
+	for _, dep := range target.Dependencies() {
+		if !done[dep.Label] && inner(dep) {
+			log.Debug("Need to rebuild %s, %s has changed", target.Label, dep.Label)
+			return dep
+		}
+	}
+	return nil
 }
 
 func mustSourceHash(state *core.BuildState, target *core.BuildTarget) []byte {
@@ -10,6 +10,8 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
 	"core"
 )
 
@@ -73,6 +75,13 @@ var KnownFields = map[string]bool{
 	"BuildingDescription": true,
 	"ShowProgress":        true,
 	"Progress":            true,
+	"InvalidationReason":  true,
+	"RebuildTrigger":      true,
+	"BuiltRemotely":       true,
+	"CPUTime":             true,
+	"IOReadBytes":         true,
+	"IOWriteBytes":        true,
+	"FDHighWater":         true,
 
 	// Used to save the rule hash rather than actually being hashed itself.
 	"RuleHash": true,
@@ -88,3 +97,52 @@ func TestAllFieldsArePresentAndAccountedFor(t *testing.T) {
 		}
 	}
 }
+
+func TestTransitiveDependencyInvalidation(t *testing.T) {
+	state := core.NewDefaultBuildState()
+	tool := newGraphTarget(state, "//src/build:tool")
+	dep := newGraphTarget(state, "//src/build:dep")
+	target := newGraphTarget(state, "//src/build:transitive")
+	target.NeedsTransitiveDependencies = true
+	target.AddTool(tool.Label)
+	state.Graph.AddDependency(target.Label, tool.Label)
+	target.AddDependency(dep.Label)
+	state.Graph.AddDependency(target.Label, dep.Label)
+
+	tool.SetState(core.Built)
+	dep.SetState(core.Unchanged)
+	assert.True(t, needsBuilding(state, target, false))
+	assert.Equal(t, core.InvalidatedByTool, target.InvalidationReason)
+	assert.Equal(t, core.TriggeredByTool, target.RebuildTrigger)
+
+	tool.SetState(core.Unchanged)
+	dep.SetState(core.Built)
+	assert.True(t, needsBuilding(state, target, false))
+	assert.Equal(t, core.InvalidatedByDependency, target.InvalidationReason)
+	assert.Equal(t, core.TriggeredBySource, target.RebuildTrigger)
+}
+
+func TestTransitiveToolInvalidation(t *testing.T) {
+	// The change is beneath the tool, which doesn't have complete outputs.
+	state := core.NewDefaultBuildState()
+	lib := newGraphTarget(state, "//src/build:lib")
+	tool := newGraphTarget(state, "//src/build:tool")
+	tool.AddDependency(lib.Label)
+	state.Graph.AddDependency(tool.Label, lib.Label)
+	target := newGraphTarget(state, "//src/build:transitive")
+	target.NeedsTransitiveDependencies = true
+	target.AddTool(tool.Label)
+	state.Graph.AddDependency(target.Label, tool.Label)
+
+	lib.SetState(core.Built)
+	tool.SetState(core.Unchanged)
+	assert.True(t, needsBuilding(state, target, false))
+	assert.Equal(t, core.InvalidatedByTool, target.InvalidationReason)
+	assert.Equal(t, core.TriggeredByTool, target.RebuildTrigger)
+}
+
+func newGraphTarget(state *core.BuildState, label string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	state.Graph.AddTarget(target)
+	return target
+}
@@ -21,10 +21,12 @@ import (
 
 	pb "build/proto/worker"
 	"core"
+	"metrics"
 )
 
 // A workerServer is the structure we use to maintain information about a remote work server.
 type workerServer struct {
+	name          string
 	requests      chan *pb.BuildRequest
 	responses     map[string]chan *pb.BuildResponse
 	responseMutex sync.Mutex
@@ -51,6 +53,7 @@ func buildMaybeRemotely(state *core.BuildState, target *core.BuildTarget, inputH
 		return nil, err
 	}
 	log.Debug("Sending remote build request for %s to %s; opts %s", target.Label, worker, workerArgs)
+	target.BuiltRemotely = true
 	resp, err := buildRemotely(state, worker, &pb.BuildRequest{
 		Rule:    target.Label.String(),
 		Labels:  target.Labels,
@@ -124,6 +127,7 @@ func getOrStartWorker(state *core.BuildState, worker string) (*workerServer, err
 		return nil, err
 	}
 	w := &workerServer{
+		name:      worker,
 		requests:  make(chan *pb.BuildRequest),
 		responses: map[string]chan *pb.BuildResponse{},
 		process:   cmd,
@@ -176,6 +180,7 @@ func (w *workerServer) readResponses(stdout io.Reader) {
 func (w *workerServer) wait() {
 	if err := w.process.Wait(); err != nil && !w.closing {
 		log.Error("Worker process died unexpectedly: %s", err)
+		metrics.RecordWorkerFailure(w.name)
 		w.responseMutex.Lock()
 		for label, ch := range w.responses {
 			ch <- &pb.BuildResponse{
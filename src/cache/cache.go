@@ -4,6 +4,7 @@ package cache
 
 import (
 	"core"
+	"metrics"
 	"net/http"
 	"sync"
 
@@ -15,7 +16,7 @@ var log = logging.MustGetLogger("cache")
 // NewCache is the factory function for creating a cache setup from the given config.
 func NewCache(config *core.Configuration) core.Cache {
 	c := newSyncCache(config, false)
-	if config.Cache.Workers > 0 {
+	if c != nil && config.Cache.Workers > 0 {
 		return newAsyncCache(c, config)
 	}
 	return c
@@ -33,6 +34,7 @@ func newSyncCache(config *core.Configuration, remoteOnly bool) core.Cache {
 			mplex.caches = append(mplex.caches, cache)
 		} else {
 			log.Warning("RPC cache server could not be reached: %s", err)
+			metrics.RecordCacheFallback("rpc", fallbackTier(mplex))
 		}
 	}
 	if config.Cache.HTTPURL != "" {
@@ -41,6 +43,7 @@ func newSyncCache(config *core.Configuration, remoteOnly bool) core.Cache {
 			mplex.caches = append(mplex.caches, newHTTPCache(config))
 		} else {
 			log.Warning("Http cache server could not be reached: %s.\nSkipping http caching...", err)
+			metrics.RecordCacheFallback("http", fallbackTier(mplex))
 		}
 	}
 	if len(mplex.caches) == 0 {
@@ -51,6 +54,14 @@ func newSyncCache(config *core.Configuration, remoteOnly bool) core.Cache {
 	return mplex
 }
 
+// fallbackTier returns a description of the cache we have left to use when a remote one is unavailable.
+func fallbackTier(mplex *cacheMultiplexer) string {
+	if len(mplex.caches) > 0 {
+		return "local"
+	}
+	return "none"
+}
+
 // A cacheMultiplexer multiplexes several caches into one.
 // Used when we have several active (eg. http, dir).
 type cacheMultiplexer struct {
@@ -21,6 +21,7 @@ import (
 
 	"core"
 	"fs"
+	"metrics"
 )
 
 type dirCache struct {
@@ -67,7 +68,8 @@ func (cache *dirCache) storeFiles(target *core.BuildTarget, key []byte, suffix,
 // storeCompressed stores all the given files in the cache as a single compressed tarball.
 func (cache *dirCache) storeCompressed(target *core.BuildTarget, filename string, files []string) uint64 {
 	log.Debug("Storing %s: %s in dir cache...", target.Label, filename)
-	if err := cache.storeCompressed2(target, filename, files); err != nil {
+	uncompressed, err := cache.storeCompressed2(target, filename, files)
+	if err != nil {
 		log.Warning("Failed to store files in cache: %s", err)
 		os.RemoveAll(filename) // Just a best-effort removal at this point
 		return 0
@@ -78,17 +80,21 @@ func (cache *dirCache) storeCompressed(target *core.BuildTarget, filename string
 		log.Warning("Can't read stored file: %s", err)
 		return 0
 	}
+	if uncompressed > 0 && info.Size() > 0 {
+		metrics.RecordCompression(float64(uncompressed) / float64(info.Size()))
+	}
 	return uint64(info.Size())
 }
 
 // storeCompressed2 stores all the given files in the cache as a single compressed tarball.
-func (cache *dirCache) storeCompressed2(target *core.BuildTarget, filename string, files []string) error {
+// It returns the total uncompressed size of the files.
+func (cache *dirCache) storeCompressed2(target *core.BuildTarget, filename string, files []string) (int64, error) {
 	if err := cache.ensureStoreReady(filename); err != nil {
-		return err
+		return 0, err
 	}
 	f, err := os.Create(filename)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer f.Close()
 	bw := bufio.NewWriter(f)
@@ -98,6 +104,7 @@ func (cache *dirCache) storeCompressed2(target *core.BuildTarget, filename strin
 	tw := tar.NewWriter(gw)
 	defer tw.Close()
 	outDir := target.OutDir()
+	var size int64
 	for _, file := range files {
 		// Any one of these might be a directory, so we have to walk them.
 		if err := fs.Walk(path.Join(outDir, file), func(name string, isDir bool) error {
@@ -110,17 +117,20 @@ func (cache *dirCache) storeCompressed2(target *core.BuildTarget, filename strin
 				f, err := os.Open(name)
 				if err != nil {
 					return err
-				} else if _, err := io.Copy(tw, f); err != nil {
+				}
+				n, err := io.Copy(tw, f)
+				if err != nil {
 					return err
 				}
+				size += n
 				f.Close() // Do not defer this, otherwise we can open too many files at once.
 			}
 			return nil
 		}); err != nil {
-			return err
+			return 0, err
 		}
 	}
-	return nil
+	return size, nil
 }
 
 // tarHeader returns an appropriate tar header for the given file.
@@ -461,6 +471,7 @@ func (cache *dirCache) clean(highWaterMark, lowWaterMark uint64) uint64 {
 			continue
 		}
 		totalSize -= entry.Size
+		metrics.RecordCacheGC(entry.Size)
 		if totalSize < lowWaterMark {
 			break
 		}
@@ -14,6 +14,7 @@ import (
 
 	"core"
 	"fs"
+	"metrics"
 )
 
 type httpCache struct {
@@ -63,6 +64,8 @@ func (cache *httpCache) StoreExtra(target *core.BuildTarget, key []byte, file st
 			log.Warning("Failed to send artifact to %s: %s", cache.URL+"/artifact/"+artifact, err)
 		} else if response.StatusCode < 200 || response.StatusCode > 299 {
 			log.Warning("Failed to send artifact to %s: got response %s", cache.URL+"/artifact/"+artifact, response.Status)
+		} else if info, err := os.Stat(file.Name()); err == nil {
+			metrics.RecordCacheBytes("http", "up", int(info.Size()))
 		}
 		response.Body.Close()
 	}
@@ -137,7 +140,9 @@ func (cache *httpCache) writeFile(target *core.BuildTarget, file string, r io.Re
 		return false
 	}
 	defer f.Close()
-	if _, err := io.Copy(f, r); err != nil {
+	n, err := io.Copy(f, r)
+	metrics.RecordCacheBytes("http", "down", int(n))
+	if err != nil {
 		log.Errorf("Failed to write file: %s", err)
 		return false
 	}
@@ -30,6 +30,7 @@ import (
 	"cache/tools"
 	"cli"
 	"fs"
+	"metrics"
 )
 
 const maxErrors = 5
@@ -150,6 +151,8 @@ func (cache *rpcCache) sendArtifacts(target *core.BuildTarget, key []byte, artif
 		if err != nil {
 			log.Warning("Error communicating with RPC cache server: %s", err)
 			cache.error()
+		} else {
+			metrics.RecordCacheBytes("rpc", "up", artifactSize(artifacts))
 		}
 		return err != nil, nil
 	})
@@ -203,6 +206,7 @@ func (cache *rpcCache) retrieveArtifacts(target *core.BuildTarget, req *pb.Retri
 	if !success {
 		return false
 	}
+	metrics.RecordCacheBytes("rpc", "down", artifactSize(artifacts))
 	// Remove any existing outputs first; this is important for cases where the output is a
 	// directory, because we get back individual artifacts, and we need to make sure that
 	// only the retrieved artifacts are present in the output.
@@ -224,6 +228,15 @@ func (cache *rpcCache) retrieveArtifacts(target *core.BuildTarget, req *pb.Retri
 	return len(artifacts) > 0
 }
 
+// artifactSize returns the total size of the contents of the given artifacts.
+func artifactSize(artifacts []*pb.Artifact) int {
+	size := 0
+	for _, artifact := range artifacts {
+		size += len(artifact.Body)
+	}
+	return size
+}
+
 func (cache *rpcCache) writeFile(target *core.BuildTarget, file string, body []byte, symlink string) bool {
 	out := path.Join(target.OutDir(), file)
 	if err := os.MkdirAll(path.Dir(out), core.DirPermissions); err != nil {
@@ -288,7 +301,9 @@ func (cache *rpcCache) connect(url string, config *core.Configuration, isSubnode
 		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(cache.maxMsgSize), grpc.MaxCallSendMsgSize(cache.maxMsgSize)),
 	}
 	if config.Cache.RPCPublicKey != "" || config.Cache.RPCCACert != "" || config.Cache.RPCSecure {
+		start := time.Now()
 		auth, err := loadAuth(config.Cache.RPCCACert, config.Cache.RPCPublicKey, config.Cache.RPCPrivateKey)
+		metrics.RecordCacheAuth(time.Since(start))
 		if err != nil {
 			log.Warning("Failed to load RPC cache auth keys: %s", err)
 			return
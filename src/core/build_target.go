@@ -118,6 +118,20 @@ type BuildTarget struct {
 	ContainerSettings *TargetContainerSettings `name:"container"`
 	// Results of test, if it is one
 	Results TestResults `print:"false"`
+	// Records why the target needed rebuilding, if it did. Used for reporting metrics.
+	InvalidationReason InvalidationReason `print:"false"`
+	// Records what kind of change triggered the target being rebuilt, if we know. Used for reporting metrics.
+	RebuildTrigger RebuildTrigger `print:"false"`
+	// True if the target was built by a remote worker rather than locally. Used for reporting metrics.
+	BuiltRemotely bool `print:"false"`
+	// Total CPU time (user + system) used by subprocesses we've run for this target.
+	CPUTime time.Duration `print:"false"`
+	// Total bytes read from & written to disk by subprocesses we've run for this target.
+	// These are only recorded on platforms where IOStatsAvailable is true.
+	IOReadBytes, IOWriteBytes int64 `print:"false"`
+	// Largest number of file descriptors held open by any process of the last command we ran
+	// for this target. This is only recorded on platforms where FDStatsAvailable is true.
+	FDHighWater int `print:"false"`
 	// Description displayed while the command is building.
 	// Default is just "Building" but it can be customised.
 	BuildingDescription string `name:"building_description"`
@@ -230,6 +244,31 @@ func (s BuildTargetState) String() string {
 	return "Unknown"
 }
 
+// An InvalidationReason describes why a target needed to be rebuilt.
+type InvalidationReason string
+
+// The reasons we can identify for a target needing to be rebuilt.
+const (
+	InvalidatedBySelf       InvalidationReason = "self"       // Something about the target itself changed (rule, sources, outputs)
+	InvalidatedByDependency InvalidationReason = "dependency" // One of its dependencies was rebuilt
+	InvalidatedByConfig     InvalidationReason = "config"     // The global configuration changed
+	InvalidatedByTool       InvalidationReason = "tool"       // One of its tools was rebuilt
+)
+
+// A RebuildTrigger describes the kind of change that caused a target to be rebuilt.
+// This is a different breakdown to InvalidationReason; it describes what changed rather
+// than where the change came from.
+type RebuildTrigger string
+
+// The triggers we can identify for a target being rebuilt.
+const (
+	TriggeredByUnknown   RebuildTrigger = "unknown"    // We don't know, e.g. it hadn't been built before
+	TriggeredByBuildFile RebuildTrigger = "build_file" // The rule definition changed
+	TriggeredBySource    RebuildTrigger = "source"     // One of its sources (or dependencies) changed
+	TriggeredByTool      RebuildTrigger = "tool"       // One of its tools was rebuilt
+	TriggeredByConfig    RebuildTrigger = "config"     // The global configuration changed
+)
+
 // TargetContainerSettings are known settings controlling containerisation for a particular target.
 type TargetContainerSettings struct {
 	// Image to use for this test
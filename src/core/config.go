@@ -108,8 +108,10 @@ func ReadConfigFiles(filenames []string, profile string) (*Configuration, error)
 
 	// We can only verify options by reflection (we need struct tags) so run them quickly through this.
 	return config, config.ApplyOverrides(map[string]string{
-		"test.defaultcontainer": config.Test.DefaultContainer,
-		"python.testrunner":     config.Python.TestRunner,
+		"test.defaultcontainer":     config.Test.DefaultContainer,
+		"python.testrunner":         config.Python.TestRunner,
+		"metrics.durationprecision": config.Metrics.DurationPrecision,
+		"metrics.durationunit":      config.Metrics.DurationUnit,
 	})
 }
 
@@ -166,6 +168,12 @@ func DefaultConfiguration() *Configuration {
 	config.Cache.RPCMaxMsgSize.UnmarshalFlag("200MiB")
 	config.Metrics.PushFrequency = cli.Duration(400 * time.Millisecond)
 	config.Metrics.PushTimeout = cli.Duration(500 * time.Millisecond)
+	config.Metrics.FinalPushTimeout = cli.Duration(5 * time.Second)
+	config.Metrics.Cooldown = cli.Duration(time.Minute)
+	config.Metrics.DurationPrecision = "ns"
+	config.Metrics.DurationUnit = "seconds"
+	config.Metrics.EnabledPercent = 100
+	config.Metrics.CachePrewarmed = "unknown"
 	config.Test.Timeout = cli.Duration(10 * time.Minute)
 	config.Test.DefaultContainer = ContainerImplementationDocker
 	config.Docker.DefaultImage = "ubuntu:trusty"
@@ -284,12 +292,53 @@ type Configuration struct {
 		RPCMaxMsgSize         cli.ByteSize `help:"Maximum size of a single message that we'll send to the RPC server.\nThis should agree with the server's limit, if it's higher the artifacts will be rejected.\nThe value is given as a byte size so can be suffixed with M, GB, KiB, etc."`
 	} `help:"Please has several built-in caches that can be configured in its config file.\n\nThe simplest one is the directory cache which by default is written into the .plz-cache directory. This allows for fast retrieval of code that has been built before (for example, when swapping Git branches).\n\nThere is also a remote RPC cache which allows using a centralised server to store artifacts. A typical pattern here is to have your CI system write artifacts into it and give developers read-only access so they can reuse its work.\n\nFinally there's a HTTP cache which is very similar, but a little obsolete now since the RPC cache outperforms it and has some extra features. Otherwise the two have similar semantics and share quite a bit of implementation.\n\nPlease has server implementations for both the RPC and HTTP caches."`
 	Metrics struct {
-		PushGatewayURL cli.URL      `help:"The URL of the pushgateway to send metrics to."`
-		PushFrequency  cli.Duration `help:"The frequency, in milliseconds, to push statistics at." example:"400ms"`
-		PushTimeout    cli.Duration `help:"Timeout on pushes to the metrics repository." example:"500ms"`
-		PerTest        bool         `help:"Emit per-test duration metrics. Off by default because they generate increased load on Prometheus."`
-	} `help:"A section of options relating to reporting metrics. Currently only pushing metrics to a Prometheus pushgateway is supported, which is enabled by the pushgatewayurl setting."`
-	CustomMetricLabels map[string]string `help:"Allows defining custom labels to be applied to metrics. The key is the name of the label, and the value is a command to be run, the output of which becomes the label's value. For example, to attach the current Git branch to all metrics:\n\n[custommetriclabels]\nbranch = git rev-parse --abbrev-ref HEAD\n\nBe careful when defining new labels, it is quite possible to overwhelm the metric collector by creating metric sets with too high cardinality."`
+		PushGatewayURL         cli.URL      `help:"The URL of the pushgateway to send metrics to."`
+		RemoteWriteURL         cli.URL      `help:"The URL of a Prometheus remote write endpoint to send metrics to, for example Grafana Cloud or Cortex. This can be used instead of or as well as a pushgateway."`
+		RemoteWriteUsername    string       `help:"Username to send to the remote write endpoint using HTTP basic auth."`
+		RemoteWritePassword    string       `help:"Password to send to the remote write endpoint using HTTP basic auth."`
+		JSONEndpoint           cli.URL      `help:"The URL of a custom collector to POST metrics to as JSON, on the same schedule as the other backends. The document has a timestamp in milliseconds and a list of metrics, each with a name, type, labels and either a value or a count, sum and buckets or quantiles."`
+		ProxyURL               cli.URL      `help:"The URL of an HTTP proxy to send metrics through. If this isn't set the standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are honoured."`
+		PushFrequency          cli.Duration `help:"The frequency, in milliseconds, to push statistics at." example:"400ms"`
+		HistogramPushFrequency cli.Duration `help:"If set, histograms are pushed at this frequency instead of pushfrequency. Histograms are much larger than the other metrics, so this allows pushing them less often. Everything is still pushed when plz exits." example:"60s"`
+		EnabledPercent         int          `help:"Percentage of invocations of plz to enable metrics for, from 0 to 100. Each invocation decides at random unless the PLZ_METRICS_SEED environment variable is set, in which case invocations with the same seed all make the same decision; for example CI can set it to the job ID so every plz command in a job is either sampled or not. Defaults to 100; zero is treated as unset so also means 100, use PLZ_DISABLE_METRICS to turn metrics off entirely." example:"10"`
+		PushEveryN             int          `help:"If set, metrics are also pushed whenever this many targets have been recorded since the last push, as well as at the regular pushfrequency." example:"500"`
+		PushOnlyOnExit         bool         `help:"Only pushes metrics once, when plz exits, rather than periodically during the build. This avoids dashboards seeing partial data from builds that are still running, at the cost of not seeing anything until they finish. It also disables pusheveryn and the heartbeat pushed at startup."`
+		PushFormat             string       `help:"Format to push metrics to the pushgateway in. By default they're sent as protobuf, which the pushgateway prefers, but some compatible services only accept the text format." options:"protobuf,text"`
+		PushPathStyle          string       `help:"Layout of the URL path to push metrics to the pushgateway at. The default is /metrics/job/please/instance/<hostname> as current versions expect; legacy is /metrics/jobs/please/instances/<hostname> for older versions, and verbatim pushes to pushgatewayurl exactly as given for any other layout." options:"default,legacy,verbatim"`
+		PushTimeout            cli.Duration `help:"Timeout on pushes to the metrics repository." example:"500ms"`
+		FinalPushTimeout       cli.Duration `help:"Timeout on the final push of metrics when plz is exiting. This is longer than pushtimeout by default since it's the most important one." example:"5s"`
+		MaxStopWait            cli.Duration `help:"If set, the longest plz will wait for metrics to be pushed when it's exiting, including waiting for any push already in progress to finish. Unlike finalpushtimeout this is a cap on everything done at exit; anything that hasn't been pushed by then is abandoned." example:"2s"`
+		Cooldown               cli.Duration `help:"How long to pause pushing metrics for after repeated errors before trying again. If this is zero we give up on metrics entirely after repeated errors." example:"1m"`
+		ClearOnStart           bool         `help:"Deletes any existing metrics in our group on the pushgateway when plz starts. Since the grouping key is the same for every build, this stops stale series from a previous build that crashed lingering there. Failures to delete are logged and otherwise ignored."`
+		PerTest                bool         `help:"Emit per-test duration metrics. Off by default because they generate increased load on Prometheus."`
+		PerTestClass           bool         `help:"Emit counts of passed and failed test cases for each class given in the test results, for example the classname attribute of JUnit XML, labelled with the class name. Off by default since there are often many more classes than tests."`
+		PerTestGranularity     string       `help:"Granularity of the test label on the per-test metrics enabled by pertest. The default, target, labels them with the full label of each test; suite labels them with only the package, which aggregates all the tests in a package into one series." options:"target,suite"`
+		SlowThreshold          cli.Duration `help:"If set, the per-test metrics enabled by pertest are only labelled with the test for tests that fail or take longer than this. Other tests are still counted, but aggregated together with an empty test label, which keeps the number of series much lower while still capturing the interesting ones." example:"30s"`
+		MinObservedDuration    cli.Duration `help:"If set, build, cache and test durations shorter than this aren't observed in the duration histograms, so lots of trivial targets don't dilute the percentiles of the ones that matter. They're still counted by the other metrics." example:"10ms"`
+		DetailedTargets        []BuildLabel `help:"Targets to always record full per-target metrics for. When set, build durations get a target label and the per-test metrics get a test label with the full label of matching targets; everything else is aggregated together with an empty label. This takes precedence over slowthreshold and pertestgranularity, and implies pertest. Can include meta-targets such as //src/core/... and //src/core:all."`
+		DisableHistograms      bool         `help:"Don't emit any duration histograms, only counts. This significantly reduces the number of series sent to Prometheus."`
+		DurationPrecision      string       `help:"Precision to round durations to before they're recorded in histograms. The default is to keep full precision." options:"ns,us,ms,s"`
+		DurationUnit           string       `help:"Unit to record durations in for the duration histograms. The bucket boundaries are scaled to match. Note that changing this changes the values of existing series without changing their names, so any dashboards or alerts built on them will need updating at the same time." options:"seconds,milliseconds"`
+		Quantiles              []string     `help:"Quantiles to calculate for any summaries, as quantile:error pairs. Each quantile must be between 0 and 1. The default is 0.5:0.05, 0.9:0.01 and 0.99:0.001." example:"0.999:0.0001"`
+		MetricPrefix           string       `help:"A prefix to apply to the names of all metrics we emit, for example plz_" example:"plz_"`
+		VersionSuffix          bool         `help:"Appends the major version of plz to the names of all metrics, for example build_counts_v16. This is useful when migrating between major versions, to stop the two versions' metrics (which may have different labels) conflicting."`
+		EventLog               string       `help:"A file to write a log of per-target events to as newline-delimited JSON. This can also be a socket address prefixed with unix:// or tcp://. Off by default." example:"plz-out/log/events.json"`
+		LogCacheKeys           bool         `help:"Logs the cache key of each target that isn't found in the cache, and writes it to the event log as a cache_miss event. This can help diagnose unexpected cache misses. Off by default since the keys are fairly long."`
+		LogSummary             bool         `help:"Logs a summary of the final metrics (the totals of each counter, and the counts & sums of each histogram) when plz exits. This works without a pushgateway or remote write endpoint configured, which is useful for quick inspection locally."`
+		OutputFile             string       `help:"A file to write the final metrics to in the Prometheus text format when plz exits. This works without a pushgateway or remote write endpoint configured, so CI systems can collect it as an artifact instead." example:"plz-out/log/metrics.txt"`
+		Tags                   []string     `help:"Static labels to apply to all metrics, as key=value pairs. These take precedence over custommetriclabels. They can also be given on the command line with --metrics_tag." example:"experiment=fast_linker"`
+		ScopedLabels           []string     `help:"Names of extra labels that can be applied to the per-target build, cache and test metrics by code calling metrics.WithLabels, for example to distinguish phases of a migration. These are empty on anything recorded without them. The names have to be given here since the set of labels on each metric is fixed when it's created." example:"migration_phase"`
+		LabelsFile             string       `help:"A JSON or YAML file containing a map of extra labels to apply to all metrics. Only a flat map of label names to string values is supported. If the file doesn't exist a warning is printed and no extra labels are added." example:"ci_labels.json"`
+		LabelCommandEnv        []string     `help:"Names of environment variables that are passed through to the commands in the custommetriclabels section. These commands don't see the full environment that plz was run with; by default they only receive PATH."`
+		CachePrewarmed         string       `help:"Whether the cache was pre-warmed before this build, for example by CI restoring a cache from a previous job. This is applied to all metrics as the cache_prewarmed label so warm and cold builds can be compared. It can be overridden by the PLZ_CACHE_PREWARMED environment variable. Defaults to unknown." options:"true,false,unknown"`
+		Invoker                string       `help:"The name of the tool or wrapper script invoking plz, which is applied to all metrics as the invoker label. This can be overridden by the PLZ_INVOKER environment variable so wrappers can set it themselves. It's empty by default." example:"plzw"`
+		BuildSequence          bool         `help:"Emits the build_sequence_number gauge, which counts the number of builds run in this repo on this machine. This is persisted in plz-out between builds, so it's useful for spotting effects that depend on how warm the machine is. Off by default since it needs a lock on a file in plz-out."`
+		IncludeHardwareLabels  bool         `help:"Adds cpu_count and mem_gb labels to all metrics describing the machine's hardware. This is useful for comparing durations across heterogeneous machines. The memory size is currently only available on Linux."`
+		IncludeGitLabels       bool         `help:"Adds git_dirty and release_tag labels to all metrics. git_dirty is true if the working tree has any uncommitted changes when plz starts, false if it doesn't and unknown if it isn't a git checkout, which is useful for excluding builds of local changes when comparing metrics. release_tag is the nearest tag to the current commit (as given by git describe --tags), or empty if there isn't one."`
+		RedactLabels           []string     `help:"Patterns to redact from the values of labels before they're sent anywhere, as label=regex pairs. Any parts of the label's value matching the regex are replaced with ***. This applies to all the constant labels (including custommetriclabels) and to the per-target test and rule labels." example:"branch=[A-Z]+-[0-9]+"`
+	} `help:"A section of options relating to reporting metrics. Metrics can be pushed to a Prometheus pushgateway, which is enabled by the pushgatewayurl setting, or to a remote write endpoint, which is enabled by the remotewriteurl setting.\n\nMetrics can be disabled regardless of these settings by setting the PLZ_DISABLE_METRICS environment variable to true."`
+	CustomMetricLabels map[string]string `help:"Allows defining custom labels to be applied to metrics. The key is the name of the label, and the value is a command to be run, the output of which becomes the label's value. The commands are run with a minimal environment containing only PATH and any variables named in metrics.labelcommandenv. For example, to attach the current Git branch to all metrics:\n\n[custommetriclabels]\nbranch = git rev-parse --abbrev-ref HEAD\n\nBe careful when defining new labels, it is quite possible to overwhelm the metric collector by creating metric sets with too high cardinality."`
+	MetricLabelRenames map[string]string `help:"Allows renaming the constant labels applied to metrics (which are user, arch and any custom labels). The key is the existing name of the label and the value is the name to apply instead. For example:\n\n[metriclabelrenames]\nuser = username"`
 	Test               struct {
 		Timeout          cli.Duration `help:"Default timeout applied to all tests. Can be overridden on a per-rule basis."`
 		DefaultContainer string       `help:"Sets the default type of containerisation to use for tests that are given container = True.\nCurrently the only available option is 'docker', we expect to add support for more engines in future." options:"none,docker"`
@@ -218,6 +218,10 @@ func TestConfigVerifiesOptions(t *testing.T) {
 	assert.Equal(t, "pytest", config.Python.TestRunner)
 	_, err = ReadConfigFiles([]string{"src/core/test_data/testrunner_bad.plzconfig"}, "")
 	assert.Error(t, err)
+	_, err = ReadConfigFiles([]string{"src/core/test_data/durationprecision_bad.plzconfig"}, "")
+	assert.Error(t, err)
+	_, err = ReadConfigFiles([]string{"src/core/test_data/durationunit_bad.plzconfig"}, "")
+	assert.Error(t, err)
 }
 
 func TestBuildEnvSection(t *testing.T) {
@@ -3,7 +3,12 @@
 package core
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -16,3 +21,37 @@ func ExecCommand(command string, args ...string) *exec.Cmd {
 	}
 	return cmd
 }
+
+// IOStatsAvailable is true if we can report how much disk I/O commands have performed.
+const IOStatsAvailable = true
+
+// ioBytes returns the number of bytes read from & written to disk by a finished process.
+// rusage reports these in 512-byte blocks.
+func ioBytes(state *os.ProcessState) (int64, int64) {
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		return usage.Inblock * 512, usage.Oublock * 512
+	}
+	return 0, 0
+}
+
+// FDStatsAvailable is true if we can report how many file descriptors commands have open.
+const FDStatsAvailable = true
+
+// openFDs returns the largest number of file descriptors held open by the given process or any
+// of its descendants. The ulimit applies to each process individually so that's the one that matters.
+func openFDs(pid int) int {
+	names, _ := ioutil.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	max := len(names)
+	tasks, _ := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	for _, task := range tasks {
+		children, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/task/%s/children", pid, task.Name()))
+		for _, child := range strings.Fields(string(children)) {
+			if childPid, err := strconv.Atoi(child); err == nil {
+				if n := openFDs(childPid); n > max {
+					max = n
+				}
+			}
+		}
+	}
+	return max
+}
@@ -2,9 +2,30 @@
 
 package core
 
-import "os/exec"
+import (
+	"os"
+	"os/exec"
+)
 
 // ExecCommand executes an external command.
 func ExecCommand(command string, args ...string) *exec.Cmd {
 	return exec.Command(command, args...)
 }
+
+// IOStatsAvailable is true if we can report how much disk I/O commands have performed.
+const IOStatsAvailable = false
+
+// ioBytes returns the number of bytes read from & written to disk by a finished process.
+// This isn't supported on this platform so it always returns zero.
+func ioBytes(state *os.ProcessState) (int64, int64) {
+	return 0, 0
+}
+
+// FDStatsAvailable is true if we can report how many file descriptors commands have open.
+const FDStatsAvailable = false
+
+// openFDs returns the largest number of file descriptors held open by the given process or any
+// of its descendants. This isn't supported on this platform so it always returns zero.
+func openFDs(pid int) int {
+	return 0
+}
@@ -228,6 +228,36 @@ func (graph *BuildGraph) AllDependenciesResolved(target *BuildTarget) bool {
 	return target.allDependenciesResolved()
 }
 
+// Depth returns the length of the longest chain of dependencies in the graph, i.e. the number
+// of targets that would have to be built one after another even with unlimited parallelism.
+func (graph *BuildGraph) Depth() int {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+	depths := make(map[*BuildTarget]int, len(graph.targets))
+	var depth func(target *BuildTarget) int
+	depth = func(target *BuildTarget) int {
+		if d, present := depths[target]; present {
+			return d // Note that this also stops us looping forever if there's a cycle.
+		}
+		depths[target] = 0
+		max := 0
+		for _, dep := range target.Dependencies() {
+			if d := depth(dep); d > max {
+				max = d
+			}
+		}
+		depths[target] = max + 1
+		return max + 1
+	}
+	max := 0
+	for _, target := range graph.targets {
+		if d := depth(target); d > max {
+			max = d
+		}
+	}
+	return max
+}
+
 // linkDependencies adds the dependency of fromTarget on toTarget and the corresponding
 // reverse dependency in the other direction.
 // This is complicated somewhat by the require/provide mechanism which is resolved at this
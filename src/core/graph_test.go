@@ -73,6 +73,24 @@ func TestAllDepsResolved(t *testing.T) {
 	assert.True(t, graph.AllDependenciesResolved(target1), "Should be resolved now we've added target1.")
 }
 
+func TestDepth(t *testing.T) {
+	graph := NewGraph()
+	assert.Equal(t, 0, graph.Depth())
+	target1 := makeTarget("//src/core:target1")
+	target2 := makeTarget("//src/core:target2", target1)
+	target3 := makeTarget("//src/core:target3", target2, target1)
+	target4 := makeTarget("//src/core:target4", target1)
+	graph.AddTarget(target1)
+	graph.AddTarget(target2)
+	graph.AddTarget(target3)
+	graph.AddTarget(target4)
+	graph.AddDependency(target2.Label, target1.Label)
+	graph.AddDependency(target3.Label, target2.Label)
+	graph.AddDependency(target3.Label, target1.Label)
+	graph.AddDependency(target4.Label, target1.Label)
+	assert.Equal(t, 3, graph.Depth())
+}
+
 func TestDependentTargets(t *testing.T) {
 	graph := NewGraph()
 	target1 := makeTarget("//src/core:target1")
@@ -432,6 +432,11 @@ func (state *BuildState) NumDone() int {
 	return int(atomic.LoadInt64(&state.progress.numDone))
 }
 
+// NumPending returns the number of tasks that are queued up and waiting to be started.
+func (state *BuildState) NumPending() int {
+	return state.pendingTasks.Len()
+}
+
 // SetTaskNumbers allows a caller to set the number of active and done tasks.
 // This may drastically confuse matters if used incorrectly.
 func (state *BuildState) SetTaskNumbers(active, done int64) {
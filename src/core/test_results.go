@@ -20,11 +20,14 @@ type TestResults struct {
 	Cached           bool          // True if the test results were retrieved from cache
 	TimedOut         bool          // True if the test failed because we timed it out.
 	Duration         time.Duration // Length of time this test took
+	CoveredLines     int           // Number of lines covered by this test, if coverage was collected
+	CoverableLines   int           // Total number of lines that could have been covered
 }
 
 // TestResult represents detailed information about a test result
 type TestResult struct {
 	Name      string        // Name of failed test
+	ClassName string        // Class the test belongs to, if the results had one (e.g. JUnit's classname)
 	Type      string        // Type of failure, eg. type of exception raised
 	Traceback string        // Traceback
 	Stdout    string        // Standard output during test
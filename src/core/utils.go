@@ -175,6 +175,32 @@ func logProgress(ctx context.Context, target *BuildTarget) {
 	}
 }
 
+// fdSampleInterval is how often we sample the number of file descriptors a command has open.
+const fdSampleInterval = 100 * time.Millisecond
+
+// watchFDs samples the number of file descriptors held open by the given process until the
+// context expires, then sends the largest number it saw on the returned channel.
+func watchFDs(ctx context.Context, pid int) <-chan int {
+	ch := make(chan int, 1)
+	go func() {
+		t := time.NewTicker(fdSampleInterval)
+		defer t.Stop()
+		max := openFDs(pid)
+		for {
+			select {
+			case <-ctx.Done():
+				ch <- max
+				return
+			case <-t.C:
+				if n := openFDs(pid); n > max {
+					max = n
+				}
+			}
+		}
+	}()
+	return ch
+}
+
 // progressMessage displays a progress message for a target, if it tracks progress.
 func progressMessage(target *BuildTarget) string {
 	if target.ShowProgress {
@@ -188,6 +214,13 @@ func progressMessage(target *BuildTarget) string {
 // If showOutput is true then output will be printed to stderr as well as returned.
 // It returns the stdout only, combined stdout and stderr and any error that occurred.
 func ExecWithTimeout(target *BuildTarget, dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput, attachStdStreams bool, argv []string) ([]byte, []byte, error) {
+	return execWithTimeout(target, dir, env, timeout, defaultTimeout, showOutput, attachStdStreams, false, argv)
+}
+
+// execWithTimeout implements ExecWithTimeout. If recordFDs is true it also records the most file
+// descriptors the command held open in target.FDHighWater; that means polling /proc while it
+// runs, so it's only done for tests.
+func execWithTimeout(target *BuildTarget, dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput, attachStdStreams, recordFDs bool, argv []string) ([]byte, []byte, error) {
 	if timeout == 0 {
 		if defaultTimeout == 0 {
 			timeout = 10 * time.Minute
@@ -229,11 +262,26 @@ func ExecWithTimeout(target *BuildTarget, dir string, env []string, timeout time
 	if err != nil {
 		return nil, nil, err
 	}
+	var fds <-chan int
+	fdCtx, fdCancel := context.WithCancel(ctx)
+	defer fdCancel()
+	if target != nil && recordFDs && FDStatsAvailable {
+		fds = watchFDs(fdCtx, cmd.Process.Pid)
+	}
 	ch := make(chan error)
 	go runCommand(cmd, ch)
 	select {
 	case err = <-ch:
-		// Do nothing.
+		if target != nil && cmd.ProcessState != nil {
+			target.CPUTime += cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+			read, write := ioBytes(cmd.ProcessState)
+			target.IOReadBytes += read
+			target.IOWriteBytes += write
+		}
+		if fds != nil {
+			fdCancel()
+			target.FDHighWater = <-fds
+		}
 	case <-time.After(timeout):
 		KillProcess(cmd)
 		err = fmt.Errorf("Timeout exceeded: %s", outerr.String())
@@ -250,11 +298,12 @@ func runCommand(cmd *exec.Cmd, ch chan error) {
 // Other arguments are as ExecWithTimeout.
 // Note that the command is deliberately a single string.
 func ExecWithTimeoutShell(state *BuildState, target *BuildTarget, dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput bool, cmd string, sandbox bool) ([]byte, []byte, error) {
-	return ExecWithTimeoutShellStdStreams(state, target, dir, env, timeout, defaultTimeout, showOutput, cmd, sandbox, false)
+	return ExecWithTimeoutShellStdStreams(state, target, dir, env, timeout, defaultTimeout, showOutput, cmd, sandbox, false, false)
 }
 
 // ExecWithTimeoutShellStdStreams is as ExecWithTimeoutShell but optionally attaches stdin to the subprocess.
-func ExecWithTimeoutShellStdStreams(state *BuildState, target *BuildTarget, dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput bool, cmd string, sandbox, attachStdStreams bool) ([]byte, []byte, error) {
+// If recordFDs is true it records the most file descriptors the command held open in target.FDHighWater.
+func ExecWithTimeoutShellStdStreams(state *BuildState, target *BuildTarget, dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput bool, cmd string, sandbox, attachStdStreams, recordFDs bool) ([]byte, []byte, error) {
 	c := append([]string{"bash", "-u", "-o", "pipefail", "-c"}, cmd)
 	// Runtime check is a little ugly, but we know this only works on Linux right now.
 	if sandbox && runtime.GOOS == "linux" {
@@ -264,7 +313,7 @@ func ExecWithTimeoutShellStdStreams(state *BuildState, target *BuildTarget, dir
 		}
 		c = append([]string{tool}, c...)
 	}
-	return ExecWithTimeout(target, dir, env, timeout, defaultTimeout, showOutput, attachStdStreams, c)
+	return execWithTimeout(target, dir, env, timeout, defaultTimeout, showOutput, attachStdStreams, recordFDs, c)
 }
 
 // ExecWithTimeoutSimple runs an external command with a timeout.
@@ -177,6 +177,25 @@ func TestExecWithTimeoutStderr(t *testing.T) {
 	assert.Equal(t, "hello\n", string(stderr))
 }
 
+func TestExecWithTimeoutFDs(t *testing.T) {
+	if !FDStatsAvailable {
+		t.Skip("File descriptor stats aren't available on this platform")
+	}
+	state := NewDefaultBuildState()
+	target := NewBuildTarget(ParseBuildLabel("//src/core:fds", ""))
+	_, _, err := ExecWithTimeoutShellStdStreams(state, target, "", nil, tenSecondsTime, tenSeconds, false, "exec 3</dev/null 4</dev/null 5</dev/null; sleep 0.3", false, false, true)
+	assert.NoError(t, err)
+	assert.True(t, target.FDHighWater >= 6, "Expected at least 6 file descriptors, got %d", target.FDHighWater)
+}
+
+func TestExecWithTimeoutNoFDs(t *testing.T) {
+	state := NewDefaultBuildState()
+	target := NewBuildTarget(ParseBuildLabel("//src/core:no_fds", ""))
+	_, _, err := ExecWithTimeoutShell(state, target, "", nil, tenSecondsTime, tenSeconds, false, "exec 3</dev/null 4</dev/null 5</dev/null; sleep 0.3", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, target.FDHighWater)
+}
+
 func TestAsyncDeleteDir(t *testing.T) {
 	err := os.MkdirAll("test_dir/a/b/c", DirPermissions)
 	assert.NoError(t, err)
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -93,12 +94,15 @@ func WriteFile(fromFile io.Reader, to string, mode os.FileMode) error {
 	return os.Rename(tempFile.Name(), to)
 }
 
+// Counts of the number of files CopyOrLinkFile has placed by each method.
+var hardlinked, symlinked, copied int64
+
 // CopyOrLinkFile either copies or hardlinks a file based on the link argument.
 // Falls back to a copy if link fails and fallback is true.
 func CopyOrLinkFile(from, to string, mode os.FileMode, link, fallback bool) error {
 	if link {
 		if err := os.Link(from, to); err == nil || !fallback {
-			return err
+			return count(&hardlinked, err)
 		} else if runtime.GOOS == "darwin" && os.IsNotExist(err) {
 			// There is an awkward issue on OSX where links to symlinks actually try to link
 			// to the target rather than the link itself. In that case we try to recreate
@@ -108,10 +112,24 @@ func CopyOrLinkFile(from, to string, mode os.FileMode, link, fallback bool) erro
 				if err != nil {
 					return err
 				}
-				return os.Symlink(dest, to)
+				return count(&symlinked, os.Symlink(dest, to))
 			}
 			return err
 		}
 	}
-	return CopyFile(from, to, mode)
+	return count(&copied, CopyFile(from, to, mode))
+}
+
+// count increments the given counter if err is nil, and returns err.
+func count(counter *int64, err error) error {
+	if err == nil {
+		atomic.AddInt64(counter, 1)
+	}
+	return err
+}
+
+// PlacementStats returns the number of files that CopyOrLinkFile has hardlinked, symlinked
+// and copied into place so far.
+func PlacementStats() (hardlinks, symlinks, copies int64) {
+	return atomic.LoadInt64(&hardlinked), atomic.LoadInt64(&symlinked), atomic.LoadInt64(&copied)
 }
@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // boolTrueHashValue is used when we need to write something indicating a bool in the input.
@@ -16,9 +17,10 @@ var boolTrueHashValue = []byte{2}
 
 // A PathHasher is responsible for hashing & remembering paths.
 type PathHasher struct {
-	memo  map[string][]byte
-	mutex sync.RWMutex
-	root  string
+	memo         map[string][]byte
+	mutex        sync.RWMutex
+	root         string
+	hits, misses int64
 }
 
 // NewPathHasher returns a new PathHasher based on the given root directory.
@@ -39,8 +41,10 @@ func (hasher *PathHasher) Hash(path string, recalc bool) ([]byte, error) {
 		cached, present := hasher.memo[path]
 		hasher.mutex.RUnlock()
 		if present {
+			atomic.AddInt64(&hasher.hits, 1)
 			return cached, nil
 		}
+		atomic.AddInt64(&hasher.misses, 1)
 	}
 	result, err := hasher.hash(path)
 	if err == nil {
@@ -51,6 +55,12 @@ func (hasher *PathHasher) Hash(path string, recalc bool) ([]byte, error) {
 	return result, err
 }
 
+// Stats returns the number of times Hash has found a path already memoised, and the number of
+// times it's had to hash one that wasn't. Forced recalculations don't count towards either.
+func (hasher *PathHasher) Stats() (hits, misses int64) {
+	return atomic.LoadInt64(&hasher.hits), atomic.LoadInt64(&hasher.misses)
+}
+
 // MustHash is as Hash but panics on error.
 func (hasher *PathHasher) MustHash(path string) []byte {
 	hash, err := hasher.Hash(path, false)
@@ -19,6 +19,18 @@ func TestHash(t *testing.T) {
 	assert.EqualValues(t, b1, b2)
 }
 
+func TestHashStats(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	h := NewPathHasher(wd)
+	h.Hash("src/fs/test_data/test_subfolder1/a.txt", false)
+	h.Hash("src/fs/test_data/test_subfolder1/a.txt", false)
+	h.Hash("src/fs/test_data/test_subfolder1/a.txt", true)
+	hits, misses := h.Stats()
+	assert.EqualValues(t, 1, hits)
+	assert.EqualValues(t, 1, misses)
+}
+
 func TestMoveHash(t *testing.T) {
 	wd, err := os.Getwd()
 	require.NoError(t, err)
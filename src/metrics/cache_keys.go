@@ -0,0 +1,91 @@
+// +build !bootstrap
+
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"core"
+)
+
+// cacheKeysFile is the file we persist the most recent cache key of each target in between runs.
+var cacheKeysFile = path.Join(core.OutDir, ".metrics_cache_keys")
+
+// A cacheKeyStore tracks the most recent cache key of each target so we can tell when they change.
+// It's loaded lazily so we don't bother reading it if we never build anything.
+type cacheKeyStore struct {
+	filename string
+	keys     map[string]string
+	changed  bool
+	loadOnce sync.Once
+	mutex    sync.Mutex
+}
+
+func newCacheKeyStore(filename string) *cacheKeyStore {
+	return &cacheKeyStore{filename: filename}
+}
+
+// Update records the given key for a target and returns true if it differs from the one
+// previously recorded for it. Targets we haven't seen before aren't considered to have changed.
+func (s *cacheKeyStore) Update(label, key string) bool {
+	s.loadOnce.Do(s.load)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous, present := s.keys[label]
+	if previous == key {
+		return false
+	}
+	s.keys[label] = key
+	s.changed = true
+	return present
+}
+
+// load reads the keys from our file. Each line is a build label followed by its key.
+func (s *cacheKeyStore) load() {
+	s.keys = map[string]string{}
+	b, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to read previous cache keys: %s", err)
+		}
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 {
+			s.keys[fields[0]] = fields[1]
+		}
+	}
+}
+
+// Save writes the keys back to our file, if any of them have changed.
+func (s *cacheKeyStore) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.changed {
+		return nil
+	}
+	labels := make([]string, 0, len(s.keys))
+	for label := range s.keys {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	var buf bytes.Buffer
+	for _, label := range labels {
+		buf.WriteString(label + " " + s.keys[label] + "\n")
+	}
+	if err := os.MkdirAll(path.Dir(s.filename), core.DirPermissions); err != nil {
+		return err
+	} else if err := ioutil.WriteFile(s.filename, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	s.changed = false
+	return nil
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_keys_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "plz-out", ".metrics_cache_keys")
+
+	s := newCacheKeyStore(filename)
+	assert.False(t, s.Update("//src/metrics:metrics", "abc"), "Not changed the first time we see it")
+	assert.False(t, s.Update("//src/core:core", "def"))
+	assert.NoError(t, s.Save())
+
+	s = newCacheKeyStore(filename)
+	assert.False(t, s.Update("//src/metrics:metrics", "abc"))
+	assert.True(t, s.Update("//src/core:core", "ghi"))
+	assert.False(t, s.Update("//src/core:core", "ghi"), "Only counts as changed once")
+	assert.NoError(t, s.Save())
+
+	s = newCacheKeyStore(filename)
+	assert.True(t, s.Update("//src/core:core", "def"))
+}
+
+func TestCacheKeyStoreNoChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_keys_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, ".metrics_cache_keys")
+	assert.NoError(t, newCacheKeyStore(filename).Save())
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err), "Shouldn't write anything if nothing was recorded")
+}
@@ -0,0 +1,34 @@
+// +build !bootstrap
+
+package metrics
+
+import "time"
+
+// A clock abstracts the parts of the time package that we use, so tests can control them.
+type clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns a new ticker that ticks at the given interval.
+	NewTicker(d time.Duration) ticker
+	// After returns a channel that receives once the given duration has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// A ticker is the equivalent of a time.Ticker.
+type ticker interface {
+	// C returns the channel that ticks are delivered on.
+	C() <-chan time.Time
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// realClock is the default implementation of clock, which just uses the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) NewTicker(d time.Duration) ticker       { return realTicker{time.NewTicker(d)} }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
@@ -0,0 +1,30 @@
+package metrics
+
+import "context"
+
+// labelsKey is the key we store scoped labels under in a context.
+type labelsKey struct{}
+
+// WithLabels returns a new context carrying the given labels, which are applied to the per-target
+// metrics recorded with it (i.e. via RecordContext). They're added to any labels already in ctx,
+// overriding them if the names are the same.
+// Only labels named in metrics.scopedlabels are applied; others are ignored since the set of
+// label names on each metric has to be fixed up front.
+func WithLabels(ctx context.Context, labels map[string]string) context.Context {
+	merged := map[string]string{}
+	for k, v := range labelsFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, labelsKey{}, merged)
+}
+
+// labelsFromContext returns the labels set on the given context by WithLabels, if any.
+func labelsFromContext(ctx context.Context) map[string]string {
+	if labels, ok := ctx.Value(labelsKey{}).(map[string]string); ok {
+		return labels
+	}
+	return nil
+}
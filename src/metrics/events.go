@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Event describes something that happened to a single target during the build.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"` // One of "start", "finish" or "cache_miss"
+	Label    string    `json:"label"`
+	Test     bool      `json:"test,omitempty"`
+	State    string    `json:"state,omitempty"`
+	Duration float64   `json:"duration,omitempty"` // In seconds, only set on finish events.
+	Passed   int       `json:"passed,omitempty"`
+	Failed   int       `json:"failed,omitempty"`
+	CacheKey string    `json:"cache_key,omitempty"` // Only set on cache_miss events.
+	RuleHash string    `json:"rule_hash,omitempty"` // Hex-encoded, only set on finish events for builds.
+}
+
+// An EventSink receives events about individual targets as they're recorded.
+// Implementations must be safe for concurrent use.
+type EventSink interface {
+	// Write sends a single event to this sink.
+	Write(event *Event) error
+	// Close closes this sink. No further events will be written after it's called.
+	Close() error
+}
+
+// NewEventSink creates a new sink that writes events as newline-delimited JSON.
+// dest is either a filename or a socket address prefixed with unix:// or tcp://.
+func NewEventSink(dest string) (EventSink, error) {
+	w, err := openEventLog(dest)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonSink{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func openEventLog(dest string) (io.WriteCloser, error) {
+	for _, network := range []string{"unix", "tcp"} {
+		if prefix := network + "://"; strings.HasPrefix(dest, prefix) {
+			return net.Dial(network, strings.TrimPrefix(dest, prefix))
+		}
+	}
+	return os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// An ndjsonSink is the default implementation of EventSink which writes events as newline-delimited JSON.
+type ndjsonSink struct {
+	w     io.WriteCloser
+	enc   *json.Encoder
+	mutex sync.Mutex
+}
+
+func (sink *ndjsonSink) Write(event *Event) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return sink.enc.Encode(event)
+}
+
+func (sink *ndjsonSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return sink.w.Close()
+}
@@ -0,0 +1,135 @@
+// +build !bootstrap
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"core"
+)
+
+// A jsonExporter is a backend that posts metrics as JSON to a custom collector.
+type jsonExporter struct {
+	url    string
+	client *http.Client
+}
+
+func newJSONExporter(config *core.Configuration) *jsonExporter {
+	return &jsonExporter{
+		url:    config.Metrics.JSONEndpoint.String(),
+		client: newHTTPClient(config),
+	}
+}
+
+// jsonMetrics is the top-level document that we send.
+type jsonMetrics struct {
+	Timestamp int64         `json:"timestamp"` // In milliseconds since the epoch.
+	Metrics   []*jsonMetric `json:"metrics"`
+}
+
+// A jsonMetric is a single series. Counters & gauges only have a value; histograms and
+// summaries have a count, sum and either buckets or quantiles.
+type jsonMetric struct {
+	Name      string             `json:"name"`
+	Type      string             `json:"type"`
+	Labels    map[string]string  `json:"labels"`
+	Value     *float64           `json:"value,omitempty"`
+	Count     *uint64            `json:"count,omitempty"`
+	Sum       *float64           `json:"sum,omitempty"`
+	Buckets   map[string]uint64  `json:"buckets,omitempty"`   // Cumulative counts keyed by upper bound.
+	Quantiles map[string]float64 `json:"quantiles,omitempty"` // Values keyed by quantile.
+}
+
+func (j *jsonExporter) Push(gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(toJSON(families, time.Now()))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, j.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("JSON export failed: %s %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// toJSON converts a set of gathered metrics to the JSON document we send.
+// As with remote write, the job & instance labels are added to match the pushgateway.
+func toJSON(families []*dto.MetricFamily, now time.Time) *jsonMetrics {
+	ret := &jsonMetrics{
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+		Metrics:   []*jsonMetric{},
+	}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			jm := &jsonMetric{
+				Name:   family.GetName(),
+				Type:   jsonTypes[family.GetType()],
+				Labels: groupingLabels(),
+			}
+			for _, label := range metric.Label {
+				jm.Labels[label.GetName()] = label.GetValue()
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				jm.Value = metric.GetCounter().Value
+			case dto.MetricType_GAUGE:
+				jm.Value = metric.GetGauge().Value
+			case dto.MetricType_UNTYPED:
+				jm.Value = metric.GetUntyped().Value
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				jm.Count = summary.SampleCount
+				jm.Sum = summary.SampleSum
+				jm.Quantiles = map[string]float64{}
+				for _, q := range summary.Quantile {
+					jm.Quantiles[formatFloat(q.GetQuantile())] = q.GetValue()
+				}
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				jm.Count = histogram.SampleCount
+				jm.Sum = histogram.SampleSum
+				jm.Buckets = map[string]uint64{}
+				for _, bucket := range histogram.Bucket {
+					jm.Buckets[formatFloat(bucket.GetUpperBound())] = bucket.GetCumulativeCount()
+				}
+				if _, present := jm.Buckets["+Inf"]; !present {
+					jm.Buckets["+Inf"] = histogram.GetSampleCount()
+				}
+			}
+			ret.Metrics = append(ret.Metrics, jm)
+		}
+	}
+	return ret
+}
+
+// jsonTypes maps metric types to the names we give them in the JSON.
+var jsonTypes = map[dto.MetricType]string{
+	dto.MetricType_COUNTER:   "counter",
+	dto.MetricType_GAUGE:     "gauge",
+	dto.MetricType_UNTYPED:   "untyped",
+	dto.MetricType_SUMMARY:   "summary",
+	dto.MetricType_HISTOGRAM: "histogram",
+}
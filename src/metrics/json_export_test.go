@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"cli"
+	"core"
+)
+
+func TestJSONExport(t *testing.T) {
+	var doc jsonMetrics
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&doc))
+	}))
+	defer server.Close()
+
+	config := core.DefaultConfiguration()
+	config.Metrics.JSONEndpoint = cli.URL(server.URL)
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_counter", Help: "A counter"}, []string{"zzz"})
+	registry.MustRegister(counter)
+	counter.WithLabelValues("hello").Inc()
+
+	assert.NoError(t, newJSONExporter(config).Push(registry))
+	assert.Equal(t, 1, len(doc.Metrics))
+	metric := doc.Metrics[0]
+	assert.Equal(t, "test_counter", metric.Name)
+	assert.Equal(t, "counter", metric.Type)
+	assert.Equal(t, 1.0, *metric.Value)
+	assert.Equal(t, "hello", metric.Labels["zzz"])
+	assert.Equal(t, "please", metric.Labels["job"])
+}
+
+func TestJSONExportHistogram(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "A histogram",
+		Buckets: []float64{0.5, 1},
+	})
+	registry.MustRegister(histogram)
+	histogram.Observe(0.7)
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	doc := toJSON(families, time.Unix(1000, 0))
+	assert.EqualValues(t, 1000000, doc.Timestamp)
+	assert.Equal(t, 1, len(doc.Metrics))
+	metric := doc.Metrics[0]
+	assert.Nil(t, metric.Value)
+	assert.EqualValues(t, 1, *metric.Count)
+	assert.Equal(t, 0.7, *metric.Sum)
+	assert.Equal(t, map[string]uint64{"0.5": 0, "1": 1, "+Inf": 1}, metric.Buckets)
+}
+
+func TestJSONExportError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	config := core.DefaultConfiguration()
+	config.Metrics.JSONEndpoint = cli.URL(server.URL)
+	assert.Error(t, newJSONExporter(config).Push(prometheus.NewRegistry()))
+}
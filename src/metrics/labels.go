@@ -0,0 +1,114 @@
+// +build !bootstrap
+
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// readLabelsFile reads a file of static labels to apply to all metrics.
+// It accepts either a JSON object or a flat YAML map of names to values.
+// If filename is empty or can't be read it returns nil.
+func readLabelsFile(filename string) map[string]string {
+	if filename == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Warning("Failed to read metric labels file: %s", err)
+		return nil
+	}
+	labels, err := parseLabels(b)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid metric labels file %s: %s", filename, err))
+	}
+	return labels
+}
+
+// parseLabels parses the contents of a labels file.
+func parseLabels(b []byte) (map[string]string, error) {
+	labels := map[string]string{}
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		return labels, json.Unmarshal(trimmed, &labels)
+	}
+	// We only handle the simplest subset of YAML here; a single level of key: value pairs.
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key: value, was %s", lineno, line)
+		}
+		labels[unquote(parts[0])] = unquote(parts[1])
+	}
+	return labels, scanner.Err()
+}
+
+// unquote trims whitespace and any surrounding quotes from a YAML scalar.
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// A labellingGatherer wraps another Gatherer and adds a set of labels to everything it gathers.
+// This lets us change labels that would otherwise have to be const labels fixed at registration.
+type labellingGatherer struct {
+	gatherer prometheus.Gatherer
+	labels   []*dto.LabelPair
+}
+
+// newLabellingGatherer returns a gatherer that adds the given labels to everything gathered
+// from g, overriding any existing labels of the same names. If there are no labels it returns g.
+func newLabellingGatherer(g prometheus.Gatherer, labels map[string]string) prometheus.Gatherer {
+	if len(labels) == 0 {
+		return g
+	}
+	lg := &labellingGatherer{gatherer: g}
+	for k, v := range labels {
+		lg.labels = append(lg.labels, &dto.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+	}
+	return lg
+}
+
+func (lg *labellingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := lg.gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			metric.Label = lg.apply(metric.Label)
+		}
+	}
+	return families, err
+}
+
+// apply returns the given labels with ours added, sorted by name as Prometheus expects.
+func (lg *labellingGatherer) apply(labels []*dto.LabelPair) []*dto.LabelPair {
+	ret := make([]*dto.LabelPair, 0, len(labels)+len(lg.labels))
+	overridden := map[string]bool{}
+	for _, label := range lg.labels {
+		overridden[label.GetName()] = true
+	}
+	for _, label := range labels {
+		if !overridden[label.GetName()] {
+			ret = append(ret, label)
+		}
+	}
+	ret = append(ret, lg.labels...)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].GetName() < ret[j].GetName() })
+	return ret
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLabelsJSON(t *testing.T) {
+	labels, err := parseLabels([]byte(`{"branch": "master", "pipeline": "ci"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"branch": "master", "pipeline": "ci"}, labels)
+}
+
+func TestParseLabelsYAML(t *testing.T) {
+	labels, err := parseLabels([]byte("---\n# CI metadata\nbranch: master\npipeline: \"ci: nightly\"\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"branch": "master", "pipeline": "ci: nightly"}, labels)
+}
+
+func TestParseLabelsInvalid(t *testing.T) {
+	_, err := parseLabels([]byte("branch master\n"))
+	assert.Error(t, err)
+}
+
+func TestReadLabelsFileMissing(t *testing.T) {
+	assert.Nil(t, readLabelsFile("doesnotexist.json"))
+}
+
+func TestLabellingGatherer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "test_counter",
+		Help:        "A counter",
+		ConstLabels: prometheus.Labels{"commit": "abc", "user": "me"},
+	}, []string{"zzz"})
+	registry.MustRegister(counter)
+	counter.WithLabelValues("hello").Inc()
+	assert.Equal(t, registry, newLabellingGatherer(registry, nil))
+
+	families, err := newLabellingGatherer(registry, map[string]string{"commit": "def", "branch": "master"}).Gather()
+	assert.NoError(t, err)
+	labels := map[string]string{}
+	names := []string{}
+	for _, label := range families[0].Metric[0].Label {
+		labels[label.GetName()] = label.GetValue()
+		names = append(names, label.GetName())
+	}
+	assert.Equal(t, map[string]string{"branch": "master", "commit": "def", "user": "me", "zzz": "hello"}, labels)
+	assert.Equal(t, []string{"branch", "commit", "user", "zzz"}, names)
+}
@@ -0,0 +1,36 @@
+// +build !bootstrap
+
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"core"
+)
+
+// writeOutputFile gathers metrics and writes them to the given file in the Prometheus text format.
+func writeOutputFile(filename string, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtText)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return err
+		}
+	}
+	if dir := path.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, core.DirPermissions); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
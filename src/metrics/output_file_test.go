@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_file_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "metrics", "metrics.txt")
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_counter", Help: "A counter"}, []string{"zzz"})
+	registry.MustRegister(counter)
+	counter.WithLabelValues("hello").Inc()
+
+	assert.NoError(t, writeOutputFile(filename, registry))
+	b, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "# HELP test_counter A counter\n# TYPE test_counter counter\ntest_counter{zzz=\"hello\"} 1\n", string(b))
+}
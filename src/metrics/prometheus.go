@@ -6,37 +6,125 @@
 package metrics
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"os"
 	"os/user"
+	"path"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/shlex"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/push"
 	"gopkg.in/op/go-logging.v1"
 
 	"core"
+	"fs"
 )
 
 var log = logging.MustGetLogger("metrics")
 
-// This is the maximum number of errors after which plz will stop attempting to send metrics.
+// buildSeqFile is the file we persist the build sequence number in between runs.
+var buildSeqFile = path.Join(core.OutDir, ".metrics_build_seq")
+
+// placementMethods are the values of the method label on output_placement_total, in the same
+// order as fs.PlacementStats returns them.
+var placementMethods = [3]string{"hardlink", "symlink", "copy"}
+
+// This is the maximum number of errors after which plz will stop attempting to send metrics
+// (until the cooldown has passed, if one is configured).
 const maxErrors = 3
 
+// These are the values of the breaker state gauge.
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
 type metrics struct {
-	url                                           string
-	newMetrics                                    bool
-	ticker                                        *time.Ticker
+	backends                                      []backend
+	registry, histogramRegistry                   *prometheus.Registry
+	gatherer                                      prometheus.Gatherer
+	extraLabels                                   map[string]string
+	extraLabelsMutex                              sync.Mutex
+	histogramTicker                               ticker
+	histogramSamples                              uint64
+	newMetrics                                    int32
+	mutex                                         sync.Mutex
+	clock                                         clock
+	ticker                                        ticker
+	done, exited, pushNow                         chan struct{}
+	pushEveryN, unpushed                          int64
+	stopOnce, firstTargetOnce                     sync.Once
+	started                                       time.Time
 	cancelled                                     bool
-	perTest                                       bool
+	cancelledAt                                   time.Time
+	cooldown                                      time.Duration
+	perTest, perTestClass                         bool
+	logCacheKeys, logSummary                      bool
+	prefix, suffix, outputFile                    string
+	scopedLabels                                  []string
+	redactions                                    map[string]*regexp.Regexp
+	constLabels                                   prometheus.Labels
+	objectives                                    map[float64]float64
+	precision, unit, slowAfter, minObserved       time.Duration
+	perTestSuite                                  bool
+	detailed                                      []core.BuildLabel
 	errors                                        int
+	lastErr                                       error
 	pushes                                        int
-	timeout                                       time.Duration
+	timeout, finalTimeout, maxStopWait            time.Duration
+	abandoned                                     bool
 	buildCounter, cacheCounter, testCounter       *prometheus.CounterVec
+	testClassCounter                              *prometheus.CounterVec
+	fallbackCounter                               *prometheus.CounterVec
+	cacheBytesCounter, remoteFetchCounter         *prometheus.CounterVec
+	testCachedCounter                             *prometheus.CounterVec
+	targetKindCounter, cacheKeyCounter            *prometheus.CounterVec
+	platformSkipCounter                           *prometheus.CounterVec
+	parseErrorCounter                             *prometheus.CounterVec
+	hashMismatchCounter                           *prometheus.CounterVec
+	workerFailureCounter                          *prometheus.CounterVec
+	cacheKeys                                     *cacheKeyStore
 	buildHistogram, cacheHistogram, testHistogram *prometheus.HistogramVec
+	cpuHistogram, cacheEntriesHistogram           *prometheus.HistogramVec
+	runHistogram, outputsHistogram                *prometheus.HistogramVec
+	inputsHistogram                               *prometheus.HistogramVec
+	testCaseHistogram                             *prometheus.HistogramVec
+	compressionHistogram                          *prometheus.HistogramVec
+	ioReadHistogram, ioWriteHistogram             *prometheus.HistogramVec
+	cacheAuthHistogram, fdHistogram               *prometheus.HistogramVec
+	queueDepthGauge, cacheEnabledGauge            prometheus.Gauge
+	breakerGauge, startupGauge, goalsGauge        prometheus.Gauge
+	graphDepthGauge, firstTargetGauge             prometheus.Gauge
+	testRequestedGauge, testEffectiveGauge        prometheus.Gauge
+	dedupCounter, runCounter, unusedCounter       prometheus.Counter
+	cancelledCounter, startedCounter              prometheus.Counter
+	memCacheHitCounter, memCacheMissCounter       prometheus.Counter
+	cacheGCEntriesCounter, cacheGCBytesCounter    prometheus.Counter
+	coverageGauge, affectedTargetsGauge           *prometheus.GaugeVec
+	buildSeqGauge                                 *prometheus.GaugeVec
+	queueDepth                                    func() int
+	memCache                                      func() (int64, int64)
+	lastMemCacheHits, lastMemCacheMisses          int64
+	placementCounter                              *prometheus.CounterVec
+	lastPlacements                                [3]int64
+	lastQueueDepth                                int
+	events                                        EventSink
+	eventErrorOnce                                sync.Once
 }
 
 // m is the singleton metrics instance.
@@ -45,9 +133,42 @@ var m *metrics
 // initOnce is used to ensure that InitFromConfig only initialises once (because Prometheus panics otherwise).
 var initOnce sync.Once
 
+// disableEnvVar is an environment variable which, if set to true, disables metrics regardless of the config.
+// This is useful for sandboxed invocations where we can't make any network calls.
+const disableEnvVar = "PLZ_DISABLE_METRICS"
+
+// seedEnvVar is an environment variable that, if set, seeds the decision made by metrics.enabledpercent
+// so that all invocations with the same seed make the same decision.
+const seedEnvVar = "PLZ_METRICS_SEED"
+
+// invokerEnvVar is an environment variable that wrapper scripts can set to identify themselves.
+// It takes precedence over the invoker in the config.
+const invokerEnvVar = "PLZ_INVOKER"
+
+// cachePrewarmedEnvVar is an environment variable that CI can set to say whether it restored the
+// cache before building. It takes precedence over cacheprewarmed in the config.
+const cachePrewarmedEnvVar = "PLZ_CACHE_PREWARMED"
+
 // InitFromConfig sets up the initial metrics from the configuration.
-func InitFromConfig(config *core.Configuration) {
-	if config.Metrics.PushGatewayURL != "" {
+// goals is the number of top-level targets requested on the command line.
+func InitFromConfig(config *core.Configuration, goals int) {
+	InitWithRegisterer(config, goals, nil)
+}
+
+// InitWithRegisterer is like InitFromConfig, but also registers all our collectors with the
+// given registerer. This is useful for programs embedding plz that want to expose its metrics
+// on their own registry. If registerer is nil it's the same as InitFromConfig, otherwise
+// metrics are initialised even if there's nowhere configured to push them to.
+// Note that this isn't available in bootstrap builds, which don't depend on Prometheus.
+func InitWithRegisterer(config *core.Configuration, goals int, registerer prometheus.Registerer) {
+	if disabledByEnv() {
+		log.Debug("Metrics disabled by %s", disableEnvVar)
+		return
+	} else if !sampled(config.Metrics.EnabledPercent, os.Getenv(seedEnvVar)) {
+		log.Debug("Metrics not enabled for this invocation, metrics.enabledpercent is %d", config.Metrics.EnabledPercent)
+		return
+	}
+	if registerer != nil || config.Metrics.PushGatewayURL != "" || config.Metrics.RemoteWriteURL != "" || config.Metrics.JSONEndpoint != "" || config.Metrics.EventLog != "" || config.Metrics.LogSummary || config.Metrics.OutputFile != "" {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Fatalf("%s", r)
@@ -55,89 +176,617 @@ func InitFromConfig(config *core.Configuration) {
 		}()
 
 		initOnce.Do(func() {
-			m = initMetrics(config.Metrics.PushGatewayURL.String(), time.Duration(config.Metrics.PushFrequency),
-				time.Duration(config.Metrics.PushTimeout), config.CustomMetricLabels, config.Metrics.PerTest)
-			prometheus.MustRegister(m.buildCounter)
-			prometheus.MustRegister(m.cacheCounter)
-			prometheus.MustRegister(m.testCounter)
-			prometheus.MustRegister(m.buildHistogram)
-			prometheus.MustRegister(m.cacheHistogram)
-			prometheus.MustRegister(m.testHistogram)
+			m = initMetrics(config)
+			m.goalsGauge.Set(float64(goals))
+			m.heartbeat()
+			if registerer != nil {
+				for _, c := range m.collectors() {
+					registerer.MustRegister(c)
+				}
+			}
 		})
 	}
 }
 
+// disabledByEnv returns true if metrics have been disabled by disableEnvVar. Any value that isn't
+// a recognisable boolean counts as disabling them, since that's most likely what was intended.
+func disabledByEnv() bool {
+	value := os.Getenv(disableEnvVar)
+	if value == "" {
+		return false
+	}
+	disabled, err := strconv.ParseBool(value)
+	return disabled || err != nil
+}
+
+// sampled returns true if metrics should be enabled for this invocation, given the percentage of
+// invocations to enable them for. If seed is non-empty the decision is derived from it, otherwise
+// it's random. Zero means the percentage is unset, so programs embedding plz that don't fill in
+// the whole config still get metrics.
+func sampled(percent int, seed string) bool {
+	if percent >= 100 || percent <= 0 {
+		return true
+	} else if seed == "" {
+		return rand.New(rand.NewSource(time.Now().UnixNano())).Intn(100) < percent
+	}
+	h := fnv.New32a()
+	h.Write([]byte(seed))
+	return int(h.Sum32()%100) < percent
+}
+
 // initMetrics initialises a new metrics instance.
 // This is deliberately not exposed but is useful for testing.
-func initMetrics(url string, frequency, timeout time.Duration, customLabels map[string]string, perTest bool) *metrics {
+func initMetrics(config *core.Configuration) *metrics {
+	return initMetricsWithClock(config, realClock{})
+}
+
+// initMetricsWithClock is like initMetrics but allows supplying the clock to use.
+func initMetricsWithClock(config *core.Configuration, clock clock) *metrics {
 	u, err := user.Current()
 	if err != nil {
 		log.Warning("Can't determine current user name for metrics")
 		u = &user.User{Username: "unknown"}
 	}
 	constLabels := prometheus.Labels{
-		"user": u.Username,
-		"arch": runtime.GOOS + "_" + runtime.GOARCH,
+		"user":             u.Username,
+		"arch":             runtime.GOOS + "_" + runtime.GOARCH,
+		"reporter_version": core.PleaseVersion.String(),
+		"max_parallel":     strconv.Itoa(config.Please.NumThreads),
+		"invoker":          config.Metrics.Invoker,
+		"cache_prewarmed":  cachePrewarmed(config.Metrics.CachePrewarmed),
+	}
+	if invoker := os.Getenv(invokerEnvVar); invoker != "" {
+		constLabels["invoker"] = invoker
+	}
+	if config.Metrics.IncludeHardwareLabels {
+		constLabels["cpu_count"] = strconv.Itoa(runtime.NumCPU())
+		constLabels["mem_gb"] = totalMemoryGB()
+	}
+	if config.Metrics.IncludeGitLabels {
+		constLabels["git_dirty"] = gitDirty(core.RepoRoot)
+		constLabels["release_tag"] = gitReleaseTag(core.RepoRoot)
 	}
-	for k, v := range customLabels {
-		constLabels[k] = deriveLabelValue(v)
+	for k, v := range readLabelsFile(config.Metrics.LabelsFile) {
+		constLabels[k] = validateLabelValue("label "+k+" in "+config.Metrics.LabelsFile, v)
+	}
+	env := labelCommandEnv(config.Metrics.LabelCommandEnv)
+	for k, v := range config.CustomMetricLabels {
+		constLabels[k] = deriveLabelValue(v, env)
+	}
+	for _, tag := range config.Metrics.Tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			panic(fmt.Sprintf("Invalid metrics tag %s, must be in the form key=value", tag))
+		}
+		constLabels[parts[0]] = validateLabelValue("metrics tag "+parts[0], parts[1])
+	}
+	for from, to := range config.MetricLabelRenames {
+		if v, present := constLabels[from]; present {
+			delete(constLabels, from)
+			constLabels[to] = v
+		}
+	}
+	redactions := parseRedactions(config.Metrics.RedactLabels)
+	for k, v := range constLabels {
+		constLabels[k] = redact(redactions, k, v)
 	}
 
 	m = &metrics{
-		url:     url,
-		timeout: timeout,
-		ticker:  time.NewTicker(frequency),
-		perTest: perTest,
+		backends:     newBackends(config),
+		timeout:      time.Duration(config.Metrics.PushTimeout),
+		finalTimeout: time.Duration(config.Metrics.FinalPushTimeout),
+		maxStopWait:  time.Duration(config.Metrics.MaxStopWait),
+		cooldown:     time.Duration(config.Metrics.Cooldown),
+		clock:        clock,
+		started:      clock.Now(),
+		ticker:       clock.NewTicker(time.Duration(config.Metrics.PushFrequency)),
+		done:         make(chan struct{}),
+		exited:       make(chan struct{}),
+		pushNow:      make(chan struct{}, 1),
+		pushEveryN:   int64(config.Metrics.PushEveryN),
+		perTest:      config.Metrics.PerTest || len(config.Metrics.DetailedTargets) > 0,
+		perTestClass: config.Metrics.PerTestClass,
+		slowAfter:    time.Duration(config.Metrics.SlowThreshold),
+		minObserved:  time.Duration(config.Metrics.MinObservedDuration),
+		perTestSuite: perTestSuite(config.Metrics.PerTestGranularity),
+		detailed:     config.Metrics.DetailedTargets,
+		logCacheKeys: config.Metrics.LogCacheKeys,
+		logSummary:   config.Metrics.LogSummary,
+		outputFile:   config.Metrics.OutputFile,
+		scopedLabels: config.Metrics.ScopedLabels,
+		prefix:       config.Metrics.MetricPrefix,
+		suffix:       versionSuffix(config.Metrics.VersionSuffix),
+		redactions:   redactions,
+		constLabels:  constLabels,
+		cacheKeys:    newCacheKeyStore(cacheKeysFile),
+		objectives:   parseQuantiles(config.Metrics.Quantiles),
+		precision:    durationPrecision(config.Metrics.DurationPrecision),
+		unit:         durationUnit(config.Metrics.DurationUnit),
+	}
+
+	if config.Metrics.EventLog != "" {
+		if m.events, err = NewEventSink(config.Metrics.EventLog); err != nil {
+			log.Warning("Failed to open event log: %s", err)
+		}
+	}
+	if config.Metrics.ClearOnStart {
+		m.clear()
 	}
 
 	// Count of builds for each target.
 	m.buildCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name:        "build_counts",
+		Name:        m.prefix + "build_counts" + m.suffix,
 		Help:        "Count of number of times each target is built",
 		ConstLabels: constLabels,
-	}, []string{"success", "incremental"})
+	}, m.addScoped([]string{"success", "incremental", "invalidation_reason", "rebuild_trigger", "sandboxed"}))
 
 	// Count of cache hits for each target
 	m.cacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name:        "cache_hits",
-		Help:        "Count of number of times we successfully retrieve from the cache",
+		Name:        m.prefix + "cache_hits" + m.suffix,
+		Help:        "Count of number of times we successfully retrieve from the cache. The cacheable label is false for targets that were never candidates for retrieval, which should be excluded when calculating a hit rate.",
 		ConstLabels: constLabels,
-	}, []string{"hit"})
+	}, m.addScoped([]string{"hit", "cacheable"}))
 
 	// Count of test runs for each target
 	m.testCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name:        "test_runs",
+		Name:        m.prefix + "test_runs" + m.suffix,
 		Help:        "Count of number of times we run each test",
 		ConstLabels: constLabels,
-	}, addTest([]string{"pass"}, perTest))
+	}, m.addScoped(addTest([]string{"pass"}, m.perTest)))
+
+	// Count of test cases run in each class, when the test results have classes.
+	m.testClassCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "test_class_results_total" + m.suffix,
+		Help:        "Count of number of test cases that passed or failed in each test class",
+		ConstLabels: constLabels,
+	}, []string{"classname", "pass"})
+
+	// Count of test runs, split by whether they actually ran or were served from the cache.
+	m.testCachedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "test_cached_total" + m.suffix,
+		Help:        "Count of number of times test results are retrieved from the cache rather than running the tests",
+		ConstLabels: constLabels,
+	}, []string{"cached"})
+
+	// Count of times a remote cache was unavailable and we fell back to another one.
+	m.fallbackCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "cache_fallback_total" + m.suffix,
+		Help:        "Count of number of times a cache was unavailable and we fell back to another tier",
+		ConstLabels: constLabels,
+	}, []string{"from", "to"})
+	// Initialise these so they're reported as zero rather than being absent until the first fallback.
+	for _, from := range []string{"rpc", "http"} {
+		for _, to := range []string{"local", "none"} {
+			m.fallbackCounter.WithLabelValues(from, to)
+		}
+	}
+
+	// Count of bytes transferred to & from the remote caches.
+	m.cacheBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "cache_bytes_total" + m.suffix,
+		Help:        "Count of bytes transferred to and from remote caches",
+		ConstLabels: constLabels,
+	}, []string{"direction", "tier"})
+
+	// Count of third-party dependencies downloaded during the build.
+	m.remoteFetchCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "remote_fetch_total" + m.suffix,
+		Help:        "Count of number of times we download third-party dependencies",
+		ConstLabels: constLabels,
+	}, []string{"kind"})
+	// Initialise these so hermetic builds report zero rather than nothing.
+	for _, kind := range []string{"go_mod", "maven", "pip", "http"} {
+		m.remoteFetchCounter.WithLabelValues(kind)
+	}
+
+	// Count of targets added to the graph, by what kind of target they are.
+	m.targetKindCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "target_kind_total" + m.suffix,
+		Help:        "Count of number of targets added to the build graph, by kind of target",
+		ConstLabels: constLabels,
+	}, []string{"kind"})
+
+	// Count of targets skipped because they're marked manual on this platform.
+	m.platformSkipCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "targets_skipped_platform_total" + m.suffix,
+		Help:        "Count of number of targets skipped by wildcards because they're marked as manual for the current platform",
+		ConstLabels: constLabels,
+	}, []string{"target_os", "target_arch"})
+
+	// Count of times each target's cache key changed since the previous build of it.
+	m.cacheKeyCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "cache_key_changes_total" + m.suffix,
+		Help:        "Count of number of times each target's cache key differs from the last time it was built",
+		ConstLabels: constLabels,
+	}, []string{"rule"})
+
+	// Count of errors encountered parsing BUILD files, by what went wrong.
+	m.parseErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "parse_errors_total" + m.suffix,
+		Help:        "Count of number of errors parsing BUILD files, either syntax errors, missing dependencies or errors evaluating them",
+		ConstLabels: constLabels,
+	}, []string{"kind"})
+	for _, kind := range []string{"syntax", "missing_dep", "type_error"} {
+		m.parseErrorCounter.WithLabelValues(kind)
+	}
+
+	// Count of outputs that didn't match the hashes declared on their target.
+	m.hashMismatchCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "output_hash_mismatch_total" + m.suffix,
+		Help:        "Count of number of times a target's outputs didn't match any of the hashes declared for it",
+		ConstLabels: constLabels,
+	}, []string{"rule"})
+
+	// Count of remote worker processes that died unexpectedly.
+	m.workerFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "worker_failures_total" + m.suffix,
+		Help:        "Count of number of times a remote worker process died unexpectedly during the build",
+		ConstLabels: constLabels,
+	}, []string{"worker"})
+
+	// Count of targets whose builds were abandoned because another target failed.
+	m.cancelledCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        m.prefix + "builds_cancelled_total" + m.suffix,
+		Help:        "Count of number of targets that were still building when the build was stopped by another target failing",
+		ConstLabels: constLabels,
+	})
+
+	// Count of builds started, which is pushed as soon as we initialise.
+	m.startedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        m.prefix + "build_started_total" + m.suffix,
+		Help:        "Count of number of times plz has started a build. This is pushed immediately so there's a record of builds that fail before anything else is recorded.",
+		ConstLabels: constLabels,
+	})
 
+	// Count of invocations of plz run.
+	m.runCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        m.prefix + "run_invocations_total" + m.suffix,
+		Help:        "Count of number of times targets are built and then run",
+		ConstLabels: constLabels,
+	})
+
+	// Count of targets that were built but weren't needed by anything we were asked for.
+	m.unusedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        m.prefix + "unused_build_outputs_total" + m.suffix,
+		Help:        "Count of number of targets built whose outputs weren't used by any of the requested targets",
+		ConstLabels: constLabels,
+	})
+
+	// Count of requests to build a target that was already scheduled.
+	m.dedupCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        m.prefix + "actions_deduplicated_total" + m.suffix,
+		Help:        "Count of number of times we skipped scheduling a target because it was already scheduled",
+		ConstLabels: constLabels,
+	})
+
+	// Entries & bytes removed from the dir cache when cleaning it.
+	m.cacheGCEntriesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        m.prefix + "cache_gc_entries_total" + m.suffix,
+		Help:        "Count of number of entries removed from the directory cache to keep it under its size limit",
+		ConstLabels: constLabels,
+	})
+	m.cacheGCBytesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        m.prefix + "cache_gc_bytes_total" + m.suffix,
+		Help:        "Count of bytes reclaimed by removing entries from the directory cache",
+		ConstLabels: constLabels,
+	})
+
+	// Hits & misses of the in-memory cache of file hashes, sampled each time we push.
+	m.memCacheHitCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        m.prefix + "mem_cache_hits_total" + m.suffix,
+		Help:        "Count of number of times a file hash was found in the in-memory cache",
+		ConstLabels: constLabels,
+	})
+	m.memCacheMissCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        m.prefix + "mem_cache_misses_total" + m.suffix,
+		Help:        "Count of number of times a file hash wasn't in the in-memory cache and had to be calculated",
+		ConstLabels: constLabels,
+	})
+
+	// Count of outputs placed by each method, sampled each time we push.
+	m.placementCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        m.prefix + "output_placement_total" + m.suffix,
+		Help:        "Count of number of files placed into plz-out (or retrieved from the dir cache) by hardlinking, symlinking or copying them",
+		ConstLabels: constLabels,
+	}, []string{"method"})
+
+	// Number of tasks waiting to be started, sampled each time we push.
+	m.queueDepthGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        m.prefix + "build_queue_depth" + m.suffix,
+		Help:        "Number of tasks queued up and waiting to be started",
+		ConstLabels: constLabels,
+	})
+
+	// Time taken to read config & initialise before we start building anything.
+	m.startupGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        m.prefix + "startup_duration" + m.suffix,
+		Help:        "Time in seconds from plz starting until it's initialised and ready to start building",
+		ConstLabels: constLabels,
+	})
+
+	// Length of the critical path through the build graph, set once it's complete.
+	m.graphDepthGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        m.prefix + "build_graph_depth" + m.suffix,
+		Help:        "Length of the longest chain of dependencies in the build graph, which bounds how quickly it can be built regardless of parallelism",
+		ConstLabels: constLabels,
+	})
+
+	// Time until the first target finished, set once when it does.
+	m.firstTargetGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        m.prefix + "time_to_first_target" + m.suffix,
+		Help:        "Time in seconds from metrics being initialised until the first target finished building or testing",
+		ConstLabels: constLabels,
+	})
+
+	// Number of targets requested on the command line.
+	m.goalsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        m.prefix + "requested_goals" + m.suffix,
+		Help:        "Number of top-level targets requested on the command line",
+		ConstLabels: constLabels,
+	})
+
+	// State of the circuit breaker that stops us pushing when the server isn't working.
+	m.breakerGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        m.prefix + "push_breaker_state" + m.suffix,
+		Help:        "State of the breaker that pauses pushes after repeated errors; 0 is closed, 1 half-open and 2 open",
+		ConstLabels: constLabels,
+	})
+
+	// Requested and actual number of tests running at once.
+	m.testRequestedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        m.prefix + "test_concurrency_requested" + m.suffix,
+		Help:        "Number of tests we've been asked to run at once",
+		ConstLabels: constLabels,
+	})
+	m.testEffectiveGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        m.prefix + "test_concurrency_effective" + m.suffix,
+		Help:        "Number of tests currently running at once",
+		ConstLabels: constLabels,
+	})
+
+	// Whether any cache is in use for this build.
+	m.cacheEnabledGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        m.prefix + "cache_enabled" + m.suffix,
+		Help:        "1 if artifacts are being cached for this build, 0 if caching is disabled or unavailable",
+		ConstLabels: constLabels,
+	})
+
+	// Coverage ratio of each test, when coverage is being collected.
+	m.coverageGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        m.prefix + "test_coverage_ratio" + m.suffix,
+		Help:        "Fraction of coverable lines covered by the test",
+		ConstLabels: constLabels,
+	}, addTest([]string{}, m.perTest))
+
+	// Number of targets affected by a set of changed files. This is a vec without labels so
+	// nothing is emitted unless it's been explicitly set (by plz query affectedtargets).
+	m.affectedTargetsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        m.prefix + "affected_targets" + m.suffix,
+		Help:        "Number of targets affected by a set of changed files",
+		ConstLabels: constLabels,
+	}, []string{})
+
+	// Sequence number of this build on this machine. Like the above this is a vec without labels
+	// so nothing is emitted unless metrics.buildsequence is set.
+	m.buildSeqGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        m.prefix + "build_sequence_number" + m.suffix,
+		Help:        "Number of builds run in this repo on this machine, including this one",
+		ConstLabels: constLabels,
+	}, []string{})
+	if config.Metrics.BuildSequence {
+		m.buildSeqGauge.WithLabelValues().Set(float64(nextBuildSeq()))
+	}
+
+	if !config.Metrics.DisableHistograms {
+		m.initHistograms(constLabels)
+	}
+
+	// We always register with our own registry, so we only push our own metrics.
+	m.registry = prometheus.NewRegistry()
+	for _, c := range m.collectors() {
+		m.registry.MustRegister(c)
+	}
+	m.gatherer = m.registry
+	if frequency := time.Duration(config.Metrics.HistogramPushFrequency); frequency > 0 && m.buildHistogram != nil {
+		// Histograms get pushed separately on their own schedule, everything else on the usual one.
+		counters := prometheus.NewRegistry()
+		for _, c := range m.counterCollectors() {
+			counters.MustRegister(c)
+		}
+		m.gatherer = counters
+		m.histogramRegistry = prometheus.NewRegistry()
+		for _, c := range m.histogramCollectors() {
+			m.histogramRegistry.MustRegister(c)
+		}
+		m.histogramTicker = clock.NewTicker(frequency)
+	}
+
+	if config.Metrics.PushOnlyOnExit {
+		close(m.exited) // Nothing to wait for in stop()
+	} else {
+		go m.keepPushing()
+	}
+
+	return m
+}
+
+// initHistograms creates the duration histograms.
+func (m *metrics) initHistograms(constLabels prometheus.Labels) {
 	// Build durations for each target
 	m.buildHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:        "build_durations_histogram",
+		Name:        m.prefix + "build_durations_histogram" + m.suffix,
 		Help:        "Durations of individual build targets",
-		Buckets:     prometheus.LinearBuckets(0, 0.1, 100),
+		Buckets:     prometheus.LinearBuckets(0, m.bucketWidth(0.1), 100),
 		ConstLabels: constLabels,
-	}, []string{})
+	}, m.addScoped(m.addDetailed([]string{"execution", "sandboxed"})))
 
 	// Cache retrieval durations for each target
 	m.cacheHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:        "cache_durations_histogram",
+		Name:        m.prefix + "cache_durations_histogram" + m.suffix,
 		Help:        "Durations to retrieve artifacts from the cache",
+		Buckets:     prometheus.LinearBuckets(0, m.bucketWidth(0.1), 100),
+		ConstLabels: constLabels,
+	}, m.addScoped([]string{}))
+
+	// Most file descriptors held open by each test
+	m.fdHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "test_fd_highwater" + m.suffix,
+		Help:        "Largest number of file descriptors held open by any process of individual test runs",
+		Buckets:     prometheus.ExponentialBuckets(8, 2, 12),
+		ConstLabels: constLabels,
+	}, []string{})
+
+	// Time taken to load the credentials for the remote cache
+	m.cacheAuthHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "cache_auth_duration_histogram" + m.suffix,
+		Help:        "Durations to load and validate the credentials used to authenticate to the remote cache",
+		Buckets:     prometheus.LinearBuckets(0, m.bucketWidth(0.01), 100),
+		ConstLabels: constLabels,
+	}, []string{})
+
+	// CPU time used by the build command for each target
+	m.cpuHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "build_cpu_seconds_histogram" + m.suffix,
+		Help:        "User + system CPU time used by individual build targets",
 		Buckets:     prometheus.LinearBuckets(0, 0.1, 100),
 		ConstLabels: constLabels,
 	}, []string{})
 
+	// Bytes read from & written to disk by the build command for each target
+	m.ioReadHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "build_io_read_bytes" + m.suffix,
+		Help:        "Bytes read from disk by individual build targets",
+		Buckets:     prometheus.ExponentialBuckets(4096, 4, 12),
+		ConstLabels: constLabels,
+	}, []string{})
+	m.ioWriteHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "build_io_write_bytes" + m.suffix,
+		Help:        "Bytes written to disk by individual build targets",
+		Buckets:     prometheus.ExponentialBuckets(4096, 4, 12),
+		ConstLabels: constLabels,
+	}, []string{})
+
+	// Number of artifacts retrieved from the cache for each target
+	m.cacheEntriesHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "cache_entries_fetched_histogram" + m.suffix,
+		Help:        "Number of cache entries fetched for each target (zero on a miss)",
+		Buckets:     prometheus.ExponentialBuckets(1, 2, 12),
+		ConstLabels: constLabels,
+	}, []string{})
+
+	// Number of declared outputs of each target
+	m.outputsHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "build_output_file_count_histogram" + m.suffix,
+		Help:        "Number of output files declared by individual build targets",
+		Buckets:     prometheus.ExponentialBuckets(1, 2, 12),
+		ConstLabels: constLabels,
+	}, []string{})
+
+	// Number of input files for each target, including the outputs of its dependencies
+	m.inputsHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "build_input_file_count_histogram" + m.suffix,
+		Help:        "Number of input files (sources and outputs of dependencies) hashed for individual build targets",
+		Buckets:     prometheus.ExponentialBuckets(1, 2, 16),
+		ConstLabels: constLabels,
+	}, []string{})
+
+	// Number of test cases in each test target
+	m.testCaseHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "test_case_count_histogram" + m.suffix,
+		Help:        "Number of test cases run by individual test targets",
+		Buckets:     prometheus.ExponentialBuckets(1, 2, 12),
+		ConstLabels: constLabels,
+	}, addTest([]string{}, m.perTest))
+
+	// Compression ratio achieved when storing artifacts in the cache
+	m.compressionHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "cache_compression_ratio" + m.suffix,
+		Help:        "Ratio of uncompressed to compressed size of artifacts stored in the cache",
+		Buckets:     prometheus.LinearBuckets(0.5, 0.5, 20),
+		ConstLabels: constLabels,
+	}, []string{})
+
+	// Durations of the build before plz run execs the target
+	m.runHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        m.prefix + "run_build_durations_histogram" + m.suffix,
+		Help:        "Durations to build targets before running them",
+		Buckets:     prometheus.LinearBuckets(0, m.bucketWidth(1), 100),
+		ConstLabels: constLabels,
+	}, []string{})
+
 	// Test durations for each target
 	m.testHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:        "test_durations_histogram",
-		Help:        "Durations to run tests",
-		Buckets:     prometheus.LinearBuckets(0, 1, 100),
+		Name:        m.prefix + "test_durations_histogram" + m.suffix,
+		Help:        "Durations to run tests, or retrieve their results from the cache",
+		Buckets:     prometheus.LinearBuckets(0, m.bucketWidth(1), 100),
 		ConstLabels: constLabels,
-	}, addTest([]string{}, perTest))
+	}, m.addScoped(addTest([]string{"cached"}, m.perTest)))
+}
 
-	go m.keepPushing()
+// collectors returns all the collectors we've created, for registration.
+func (m *metrics) collectors() []prometheus.Collector {
+	return append(m.counterCollectors(), m.histogramCollectors()...)
+}
 
-	return m
+// counterCollectors returns all the collectors we've created, except for histograms.
+func (m *metrics) counterCollectors() []prometheus.Collector {
+	return []prometheus.Collector{m.buildCounter, m.cacheCounter, m.testCounter, m.testClassCounter, m.testCachedCounter, m.targetKindCounter, m.cacheKeyCounter, m.platformSkipCounter, m.parseErrorCounter, m.workerFailureCounter, m.hashMismatchCounter, m.cancelledCounter, m.startedCounter, m.fallbackCounter, m.cacheBytesCounter, m.remoteFetchCounter, m.dedupCounter, m.runCounter, m.unusedCounter, m.memCacheHitCounter, m.memCacheMissCounter, m.placementCounter, m.cacheGCEntriesCounter, m.cacheGCBytesCounter, m.queueDepthGauge, m.cacheEnabledGauge, m.breakerGauge, m.startupGauge, m.goalsGauge, m.graphDepthGauge, m.firstTargetGauge, m.testRequestedGauge, m.testEffectiveGauge, m.coverageGauge, m.affectedTargetsGauge, m.buildSeqGauge}
+}
+
+// histogramCollectors returns all the histograms we've created, or nothing if they're disabled.
+func (m *metrics) histogramCollectors() []prometheus.Collector {
+	if m.buildHistogram == nil {
+		return nil
+	}
+	return []prometheus.Collector{m.buildHistogram, m.cacheHistogram, m.testHistogram, m.cpuHistogram, m.cacheEntriesHistogram, m.runHistogram, m.outputsHistogram, m.inputsHistogram, m.testCaseHistogram, m.compressionHistogram, m.ioReadHistogram, m.ioWriteHistogram, m.cacheAuthHistogram, m.fdHistogram}
+}
+
+// perTargetLabel returns the value of a per-target label for the given target.
+// If metrics.detailedtargets is set this is the full label for targets matching it and empty
+// for everything else, regardless of the other options. Otherwise if metrics.slowthreshold is set this is empty (so everything is aggregated into one series)
+// unless the target failed or took longer than the threshold. If metrics.pertestgranularity
+// is suite it's only the target's package, so all the targets in a package are aggregated.
+func (m *metrics) perTargetLabel(name string, target *core.BuildTarget, duration time.Duration, failed bool) string {
+	if len(m.detailed) > 0 {
+		if !m.isDetailed(target) {
+			return ""
+		}
+	} else if m.slowAfter > 0 && !failed && duration < m.slowAfter {
+		return ""
+	} else if m.perTestSuite {
+		return redact(m.redactions, name, "//"+target.Label.PackageName)
+	}
+	return redact(m.redactions, name, target.Label.String())
+}
+
+// perTestSuite returns true if the given value of Metrics.PerTestGranularity means the per-test
+// metrics should be aggregated by package. It panics if it's not one we know about.
+func perTestSuite(granularity string) bool {
+	switch granularity {
+	case "", "target":
+		return false
+	case "suite":
+		return true
+	}
+	panic(fmt.Sprintf("Invalid metrics.pertestgranularity %q, must be target or suite", granularity))
+}
+
+// isDetailed returns true if the given target matches any of metrics.detailedtargets.
+func (m *metrics) isDetailed(target *core.BuildTarget) bool {
+	for _, label := range m.detailed {
+		if label.Includes(target.Label) {
+			return true
+		}
+	}
+	return false
+}
+
+// addDetailed adds a per-target label to the given slice if metrics.detailedtargets is set.
+func (m *metrics) addDetailed(s []string) []string {
+	if len(m.detailed) > 0 {
+		return append(s, "target")
+	}
+	return s
 }
 
 // addTest adds a per-test label to the given slice.
@@ -148,127 +797,1172 @@ func addTest(s []string, perTest bool) []string {
 	return s
 }
 
+// addScoped adds the labels that can be set by WithLabels to the given slice.
+func (m *metrics) addScoped(s []string) []string {
+	return append(s, m.scopedLabels...)
+}
+
+// scopeValues returns the values of the scoped labels set on the given context.
+func (m *metrics) scopeValues(ctx context.Context) []string {
+	labels := labelsFromContext(ctx)
+	ret := make([]string, len(m.scopedLabels))
+	for i, name := range m.scopedLabels {
+		ret[i] = redact(m.redactions, name, labels[name])
+	}
+	return ret
+}
+
 // Stop shuts down the metrics and ensures the final ones are sent before returning.
 func Stop() {
+	StopE()
+}
+
+// StopE is like Stop but returns any error from the final push, or the last error that caused
+// pushing to be abandoned. It's safe to call more than once; later calls only push again if
+// there are new metrics since the last one, and otherwise return the previous outcome.
+func StopE() error {
 	if m != nil {
-		m.stop()
+		return m.stop()
 	}
+	return nil
 }
 
-func (m *metrics) stop() {
-	m.ticker.Stop()
-	if !m.cancelled {
-		m.errors = m.pushMetrics()
+// RecordCacheEnabled records whether the build is using a cache, after all flags & config have been considered.
+func RecordCacheEnabled(enabled bool) {
+	if m != nil {
+		m.recordCacheEnabled(enabled)
 	}
 }
 
-// Record records metrics for the given target.
-func Record(target *core.BuildTarget, duration time.Duration) {
+func (m *metrics) recordCacheEnabled(enabled bool) {
+	if enabled {
+		m.cacheEnabledGauge.Set(1)
+	} else {
+		m.cacheEnabledGauge.Set(0)
+	}
+	m.markNew()
+}
+
+// SetLabels sets labels to apply to all metrics the next time they're pushed, replacing any
+// previously set this way. This is intended for long-running processes (e.g. server mode) where
+// metadata such as the current commit changes between builds, which const labels can't handle since
+// they're fixed when the metrics are created. Note that any change in these labels starts a new
+// set of series (although the pushgateway replaces the old ones) so they should change rarely;
+// once per build is fine, once per target is not.
+func SetLabels(labels map[string]string) {
 	if m != nil {
-		m.record(target, duration)
+		m.setLabels(labels)
 	}
 }
 
-func (m *metrics) record(target *core.BuildTarget, duration time.Duration) {
-	if target.Results.NumTests > 0 {
-		// Tests have run
-		m.cacheCounter.WithLabelValues(b(target.Results.Cached)).Inc()
-		if m.perTest {
-			m.testCounter.WithLabelValues(b(target.Results.Failed == 0), target.Label.String()).Inc()
+func (m *metrics) setLabels(labels map[string]string) {
+	m.extraLabelsMutex.Lock()
+	defer m.extraLabelsMutex.Unlock()
+	m.extraLabels = map[string]string{}
+	for k, v := range labels {
+		m.extraLabels[k] = redact(m.redactions, k, validateLabelValue("label "+k, v))
+	}
+	m.markNew()
+}
+
+// RecordStartup records how long it took from plz starting until it was ready to build.
+// It should be called once, at the end of initialisation.
+func RecordStartup(duration time.Duration) {
+	if m != nil {
+		m.startupGauge.Set(duration.Seconds())
+		m.markNew()
+	}
+}
+
+// SetAffectedTargets records the number of targets affected by a set of changed files.
+// The value is sent on the next push (typically the final one from Stop).
+func SetAffectedTargets(n int) {
+	if m != nil {
+		m.affectedTargetsGauge.WithLabelValues().Set(float64(n))
+		m.markNew()
+	}
+}
+
+// SampleQueueDepth sets a function that is called on each push to sample the current length of the build queue.
+func SampleQueueDepth(f func() int) {
+	if m != nil {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.queueDepth = f
+	}
+}
+
+// SampleMemCache sets a function that is called on each push to sample the total number of hits &
+// misses of the in-memory hash cache (typically the PathHasher's Stats method).
+func SampleMemCache(f func() (hits, misses int64)) {
+	if m != nil {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.memCache = f
+	}
+}
+
+func (m *metrics) stop() error {
+	start := m.clock.Now()
+	m.stopOnce.Do(func() {
+		m.ticker.Stop()
+		if m.histogramTicker != nil {
+			m.histogramTicker.Stop()
+		}
+		close(m.done)
+		// Wait for any in-flight push to finish before we do the final one.
+		if m.maxStopWait > 0 {
+			select {
+			case <-m.exited:
+			case <-m.clock.After(m.maxStopWait):
+				log.Warning("Abandoning push of metrics, already waited %s for the previous one", m.maxStopWait)
+				m.abandoned = true
+			}
 		} else {
-			m.testCounter.WithLabelValues(b(target.Results.Failed == 0)).Inc()
-		}
-		if target.Results.Cached {
-			m.cacheHistogram.WithLabelValues().Observe(duration.Seconds())
-		} else if target.Results.Failed == 0 {
-			if m.perTest {
-				m.testHistogram.WithLabelValues(target.Label.String()).Observe(duration.Seconds())
-			} else {
-				m.testHistogram.WithLabelValues().Observe(duration.Seconds())
+			<-m.exited
+		}
+		if m.events != nil {
+			if err := m.events.Close(); err != nil {
+				log.Warning("Failed to close event log: %s", err)
 			}
 		}
-	} else {
-		// Build has run
-		state := target.State()
-		m.cacheCounter.WithLabelValues(b(state == core.Cached)).Inc()
-		m.buildCounter.WithLabelValues(b(state != core.Failed), b(state != core.Reused)).Inc()
-		if state == core.Cached {
-			m.cacheHistogram.WithLabelValues().Observe(duration.Seconds())
-		} else if state != core.Failed && state >= core.Built {
-			m.buildHistogram.WithLabelValues().Observe(duration.Seconds())
+	})
+	if m.abandoned {
+		// keepPushing is still going so we can't touch anything it uses.
+		return fmt.Errorf("Gave up waiting for metrics to be pushed after %s", m.maxStopWait)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.queueDepth = nil
+	m.queueDepthGauge.Set(0)
+	m.sampleMemCache()
+	m.samplePlacements()
+	if err := m.cacheKeys.Save(); err != nil {
+		log.Warning("Failed to save cache keys: %s", err)
+	}
+	if m.histogramRegistry != nil {
+		// The final push sends everything, including any histograms we haven't pushed yet.
+		if m.newHistogramSamples() {
+			m.markNew()
+		}
+		m.gatherer = m.registry
+	}
+	timeout := m.finalTimeout
+	outOfTime := false
+	if m.maxStopWait > 0 {
+		if remaining := m.maxStopWait - m.clock.Now().Sub(start); remaining < timeout {
+			timeout = remaining
+			outOfTime = remaining <= 0
+		}
+	}
+	if !m.cancelled {
+		if outOfTime {
+			log.Warning("Abandoning final push of metrics, already waited %s to stop", m.maxStopWait)
+		} else {
+			m.errors = m.pushMetrics(timeout)
+		}
+	}
+	if m.outputFile != "" {
+		if err := writeOutputFile(m.outputFile, m.labelled(m.registry)); err != nil {
+			log.Warning("Failed to write metrics to %s: %s", m.outputFile, err)
+		}
+	}
+	if m.logSummary {
+		if summary, err := summarise(m.registry, m.constLabels); err != nil {
+			log.Warning("Failed to summarise metrics: %s", err)
+		} else {
+			log.Info("Metrics summary: %s", summary)
 		}
 	}
-	m.newMetrics = true
+	return m.lastErr
 }
 
-func b(value bool) string {
-	if value {
-		return "true"
+// RecordStart records that we're starting to build or test the given target.
+// This is only used for the event log; aggregate metrics are only recorded once it's finished.
+func RecordStart(target *core.BuildTarget, test bool) {
+	if m != nil {
+		m.emit(&Event{Type: "start", Label: target.Label.String(), Test: test})
 	}
-	return "false"
 }
 
-func (m *metrics) keepPushing() {
-	for range m.ticker.C {
-		m.errors = m.pushMetrics()
-		if m.errors >= maxErrors {
-			log.Warning("Metrics don't seem to be working, giving up")
-			m.cancelled = true
-			return
-		}
-	}
+// Record records metrics for the given target.
+func Record(target *core.BuildTarget, duration time.Duration) {
+	RecordContext(context.Background(), target, duration)
 }
 
-// deadline applies a deadline to an arbitrary function and returns when either the function
-// completes or the deadline expires.
-func deadline(f func() error, timeout time.Duration) error {
-	c := make(chan error)
-	go func() {
-		c <- f()
-	}()
-	select {
-	case err := <-c:
-		return err
-	case <-time.After(timeout):
-		return fmt.Errorf("Metrics push timed out")
+// RecordContext is like Record, but also applies any labels set on ctx by WithLabels.
+func RecordContext(ctx context.Context, target *core.BuildTarget, duration time.Duration) {
+	if m != nil {
+		m.record(ctx, target, duration)
 	}
 }
 
-// pushMetrics attempts to send some new metrics to the server. It returns the new number of errors.
-func (m *metrics) pushMetrics() int {
-	if !m.newMetrics {
-		return m.errors
+// RecordCPU records the CPU time used by building the given target.
+func RecordCPU(target *core.BuildTarget, cpuSeconds float64) {
+	if m != nil && m.cpuHistogram != nil {
+		m.cpuHistogram.WithLabelValues().Observe(cpuSeconds)
+		m.markNew()
 	}
-	start := time.Now()
-	m.newMetrics = false
-	if err := deadline(func() error {
-		return push.AddFromGatherer("please", push.HostnameGroupingKey(), m.url, prometheus.DefaultGatherer)
-	}, m.timeout); err != nil {
-		log.Warning("Could not push metrics to the repository: %s", err)
-		m.newMetrics = true
-		return m.errors + 1
+}
+
+// RecordIO records the number of bytes read from & written to disk by building the given target.
+// It shouldn't be called on platforms where that isn't available.
+func RecordIO(target *core.BuildTarget, read, write int64) {
+	if m != nil && m.ioReadHistogram != nil {
+		m.ioReadHistogram.WithLabelValues().Observe(float64(read))
+		m.ioWriteHistogram.WithLabelValues().Observe(float64(write))
+		m.markNew()
 	}
-	m.pushes++
-	log.Debug("Push #%d of metrics in %0.3fs", m.pushes, time.Since(start).Seconds())
-	return 0
 }
 
-// deriveLabelValue runs a command and returns its output.
+// RecordCacheEntries records the number of entries fetched from the cache for the given target.
+func RecordCacheEntries(target *core.BuildTarget, count int) {
+	if m != nil && m.cacheEntriesHistogram != nil {
+		m.cacheEntriesHistogram.WithLabelValues().Observe(float64(count))
+		m.markNew()
+	}
+}
+
+// RecordCompression records the compression ratio (i.e. uncompressed size / compressed size) of
+// an artifact stored in the cache. It shouldn't be called if the cache isn't compressing artifacts.
+func RecordCompression(ratio float64) {
+	if m != nil && m.compressionHistogram != nil {
+		m.compressionHistogram.WithLabelValues().Observe(ratio)
+		m.markNew()
+	}
+}
+
+// RecordCacheMiss records that the given target wasn't found in the cache under the given key.
+// This does nothing unless metrics.logcachekeys is set, in which case the key is logged and
+// written to the event log to help correlate cache misses.
+func RecordCacheMiss(target *core.BuildTarget, key []byte) {
+	if m != nil {
+		m.recordCacheMiss(target, key)
+	}
+}
+
+func (m *metrics) recordCacheMiss(target *core.BuildTarget, key []byte) {
+	if m.logCacheKeys {
+		cacheKey := base64.RawURLEncoding.EncodeToString(key)
+		log.Debug("Cache miss for %s with key %s", target.Label, cacheKey)
+		m.emit(&Event{Type: "cache_miss", Label: target.Label.String(), CacheKey: cacheKey})
+	}
+}
+
+// RecordCacheKey records the cache key of the given target before it's built or retrieved from the cache.
+// The key is compared to the one recorded for the target by a previous build (which is persisted in
+// plz-out) so we can count how often it changes.
+func RecordCacheKey(target *core.BuildTarget, key []byte) {
+	if m != nil {
+		m.recordCacheKey(target, key)
+	}
+}
+
+func (m *metrics) recordCacheKey(target *core.BuildTarget, key []byte) {
+	if m.cacheKeys.Update(target.Label.String(), base64.RawURLEncoding.EncodeToString(key)) {
+		m.cacheKeyCounter.WithLabelValues(redact(m.redactions, "rule", target.Label.String())).Inc()
+		m.markNew()
+	}
+}
+
+// RecordDedup records that we've skipped scheduling a target because it was already scheduled.
+func RecordDedup() {
+	if m != nil {
+		m.dedupCounter.Inc()
+		m.markNew()
+	}
+}
+
+// RecordRemoteFetch records that we've downloaded a third-party dependency of the given kind.
+func RecordRemoteFetch(kind string) {
+	if m != nil {
+		m.remoteFetchCounter.WithLabelValues(kind).Inc()
+		m.markNew()
+	}
+}
+
+// SetGraphDepth records the length of the longest chain of dependencies in the build graph.
+// It should be called once the graph is complete, typically just before Stop.
+func SetGraphDepth(n int) {
+	if m != nil {
+		m.graphDepthGauge.Set(float64(n))
+		m.markNew()
+	}
+}
+
+// RecordUnusedTargets records the number of targets in the graph that were built, but weren't
+// needed by any of the given goals (typically the expanded original targets). It should be called
+// once, after the build has finished, since it walks the whole graph.
+func RecordUnusedTargets(graph *core.BuildGraph, goals core.BuildLabels) {
+	if m != nil {
+		if n := unusedTargets(graph, goals); n > 0 {
+			m.unusedCounter.Add(float64(n))
+			m.markNew()
+		}
+	}
+}
+
+// unusedTargets returns the number of targets that were built but aren't reachable from the given goals.
+// Tools of reachable targets and anything subincluded by a package in the graph count as reachable,
+// since they're needed to build the goals even though nothing may depend on them directly.
+func unusedTargets(graph *core.BuildGraph, goals core.BuildLabels) int {
+	needed := map[*core.BuildTarget]bool{}
+	var visit func(target *core.BuildTarget)
+	visitLabel := func(label core.BuildLabel) {
+		if target := graph.Target(label); target != nil {
+			visit(target)
+		}
+	}
+	visit = func(target *core.BuildTarget) {
+		if !needed[target] {
+			needed[target] = true
+			for _, dep := range target.Dependencies() {
+				visit(dep)
+			}
+			for _, tool := range target.AllTools() {
+				if label := tool.Label(); label != nil {
+					visitLabel(*label)
+				}
+			}
+		}
+	}
+	for _, goal := range goals {
+		visitLabel(goal)
+	}
+	for _, pkg := range graph.PackageMap() {
+		for _, subinclude := range pkg.Subincludes {
+			visitLabel(subinclude)
+		}
+	}
+	n := 0
+	for _, target := range graph.AllTargets() {
+		if state := target.State(); (state == core.Built || state == core.Cached || state == core.Unchanged) && !needed[target] {
+			n++
+		}
+	}
+	return n
+}
+
+// RecordTargetKind records that the given target has been added to the build graph.
+func RecordTargetKind(target *core.BuildTarget) {
+	if m != nil {
+		m.targetKindCounter.WithLabelValues(targetKind(target)).Inc()
+		m.markNew()
+	}
+}
+
+// RecordPlatformSkip records that a target was skipped because it's marked as manual on the
+// given platform, i.e. it's labelled manual:<os>_<arch>.
+func RecordPlatformSkip(os, arch string) {
+	if m != nil {
+		m.platformSkipCounter.WithLabelValues(os, arch).Inc()
+		m.markNew()
+	}
+}
+
+// targetKind returns the kind of the given target, for the target_kind_total metric.
+// Aliases are targets that have no command or outputs of their own and only exist to depend on other targets.
+func targetKind(target *core.BuildTarget) string {
+	if target.IsTest {
+		return "test"
+	} else if target.IsRemoteFile {
+		return "remote_file"
+	} else if target.IsHashFilegroup {
+		return "hash_filegroup"
+	} else if target.IsFilegroup {
+		return "filegroup"
+	} else if target.Command == "" && len(target.Commands) == 0 && len(target.DeclaredOutputs()) == 0 {
+		return "alias"
+	}
+	return "rule"
+}
+
+// RecordParseError records an error parsing a BUILD file. kind is syntax if the file couldn't be
+// parsed at all, type_error if it failed while being evaluated, or missing_dep if it didn't define
+// a target that something else depended on.
+func RecordParseError(kind string) {
+	if m != nil {
+		m.parseErrorCounter.WithLabelValues(kind).Inc()
+		m.markNew()
+	}
+}
+
+// RecordWorkerFailure records that the given remote worker died unexpectedly while we were using it.
+func RecordWorkerFailure(worker string) {
+	if m != nil {
+		m.workerFailureCounter.WithLabelValues(worker).Inc()
+		m.markNew()
+	}
+}
+
+// RecordHashMismatch records that the outputs of the given target didn't match its declared hashes.
+func RecordHashMismatch(target *core.BuildTarget) {
+	if m != nil {
+		m.hashMismatchCounter.WithLabelValues(redact(m.redactions, "rule", target.Label.String())).Inc()
+		m.markNew()
+	}
+}
+
+// RecordCancelled records that the given target was still building when the build was stopped
+// because another target failed. These aren't counted as failures themselves.
+func RecordCancelled(target *core.BuildTarget) {
+	if m != nil {
+		m.cancelledCounter.Inc()
+		m.markNew()
+	}
+}
+
+// RecordRun records that we've built targets for plz run and are about to run them.
+// The duration covers only the build; once the target is exec'd it's out of our hands.
+func RecordRun(duration time.Duration) {
+	if m != nil {
+		m.runCounter.Inc()
+		m.observe(m.runHistogram, duration)
+		m.markNew()
+	}
+}
+
+// RecordFDs records the largest number of file descriptors the given test had open while it ran.
+func RecordFDs(target *core.BuildTarget, count int) {
+	if m != nil && m.fdHistogram != nil {
+		m.fdHistogram.WithLabelValues().Observe(float64(count))
+		m.markNew()
+	}
+}
+
+// RecordCacheAuth records how long it took to load the credentials for authenticating to the remote cache.
+func RecordCacheAuth(duration time.Duration) {
+	if m != nil && m.cacheAuthHistogram != nil {
+		m.observe(m.cacheAuthHistogram, duration)
+		m.markNew()
+	}
+}
+
+// RecordCacheGC records that an entry of the given size was removed from the dir cache while cleaning it.
+func RecordCacheGC(size uint64) {
+	if m != nil {
+		m.cacheGCEntriesCounter.Inc()
+		m.cacheGCBytesCounter.Add(float64(size))
+		m.markNew()
+	}
+}
+
+// RecordCacheFallback records that the given cache tier was unavailable and we fell back to another.
+func RecordCacheFallback(from, to string) {
+	if m != nil {
+		m.fallbackCounter.WithLabelValues(from, to).Inc()
+		m.markNew()
+	}
+}
+
+// RecordCacheBytes records a number of bytes transferred to or from a remote cache.
+// direction is either "up" or "down".
+func RecordCacheBytes(tier, direction string, n int) {
+	if m != nil && n > 0 {
+		m.cacheBytesCounter.WithLabelValues(direction, tier).Add(float64(n))
+		m.markNew()
+	}
+}
+
+// RecordTestConcurrency records the requested and effective number of tests running concurrently.
+// It's called as each test starts & finishes.
+func RecordTestConcurrency(requested, effective int) {
+	if m != nil {
+		m.testRequestedGauge.Set(float64(requested))
+		m.testEffectiveGauge.Set(float64(effective))
+		m.markNew()
+	}
+}
+
+// record records metrics for the given target. Any scoped labels are taken from ctx.
+// Durations shorter than metrics.minobservedduration are counted but not observed in the
+// duration histograms.
+func (m *metrics) record(ctx context.Context, target *core.BuildTarget, duration time.Duration) {
+	m.firstTargetOnce.Do(func() {
+		m.firstTargetGauge.Set(m.clock.Now().Sub(m.started).Seconds())
+	})
+	scope := m.scopeValues(ctx)
+	scoped := func(labels ...string) []string {
+		return append(labels, scope...)
+	}
+	observed := duration >= m.minObserved
+	if target.Results.NumTests > 0 {
+		// Tests have run
+		m.cacheCounter.WithLabelValues(scoped(b(target.Results.Cached), "true")...).Inc()
+		m.testCachedCounter.WithLabelValues(b(target.Results.Cached)).Inc()
+		testLabels := []string{}
+		if m.perTest {
+			testLabels = append(testLabels, m.perTargetLabel("test", target, duration, target.Results.Failed > 0))
+		}
+		m.testCounter.WithLabelValues(scoped(append([]string{b(target.Results.Failed == 0)}, testLabels...)...)...).Inc()
+		if target.Results.Failed == 0 && observed {
+			m.observe(m.testHistogram, duration, scoped(append([]string{b(target.Results.Cached)}, testLabels...)...)...)
+		}
+		if m.perTestClass {
+			for _, result := range target.Results.Results {
+				if result.ClassName != "" {
+					m.testClassCounter.WithLabelValues(redact(m.redactions, "classname", result.ClassName), b(result.Success || result.Skipped)).Inc()
+				}
+			}
+		}
+		if m.testCaseHistogram != nil {
+			m.testCaseHistogram.WithLabelValues(testLabels...).Observe(float64(target.Results.NumTests))
+		}
+		if target.Results.CoverableLines > 0 {
+			ratio := float64(target.Results.CoveredLines) / float64(target.Results.CoverableLines)
+			m.coverageGauge.WithLabelValues(testLabels...).Set(ratio)
+		}
+		m.emit(&Event{
+			Type:     "finish",
+			Label:    target.Label.String(),
+			Test:     true,
+			Duration: duration.Seconds(),
+			Passed:   target.Results.Passed,
+			Failed:   target.Results.Failed,
+		})
+	} else {
+		// Build has run
+		state := target.State()
+		m.cacheCounter.WithLabelValues(scoped(b(state == core.Cached), cacheable(target))...).Inc()
+		m.buildCounter.WithLabelValues(scoped(b(state != core.Failed), b(state != core.Reused), invalidationReason(target), rebuildTrigger(target), sandboxed(target))...).Inc()
+		if observed {
+			if state == core.Cached {
+				m.observe(m.cacheHistogram, duration, scoped()...)
+			} else if state != core.Failed && state >= core.Built {
+				buildLabels := []string{execution(target), sandboxed(target)}
+				if len(m.detailed) > 0 {
+					buildLabels = append(buildLabels, m.perTargetLabel("target", target, duration, false))
+				}
+				m.observe(m.buildHistogram, duration, scoped(buildLabels...)...)
+			}
+		}
+		if state != core.Failed && m.outputsHistogram != nil {
+			m.outputsHistogram.WithLabelValues().Observe(float64(len(target.Outputs())))
+			m.inputsHistogram.WithLabelValues().Observe(float64(inputFileCount(target)))
+		}
+		m.emit(&Event{
+			Type:     "finish",
+			Label:    target.Label.String(),
+			State:    state.String(),
+			Duration: duration.Seconds(),
+			RuleHash: hex.EncodeToString(target.RuleHash),
+		})
+	}
+	m.markNew()
+	m.recorded()
+}
+
+// emit sends an event to the event log, if there is one.
+func (m *metrics) emit(event *Event) {
+	if m.events != nil {
+		event.Time = m.clock.Now()
+		if err := m.events.Write(event); err != nil {
+			m.eventErrorOnce.Do(func() { log.Warning("Failed to write to event log: %s", err) })
+		}
+	}
+}
+
+// invalidationReason returns the reason a target was rebuilt, defaulting to the target itself
+// if we don't know any better.
+func invalidationReason(target *core.BuildTarget) string {
+	if target.InvalidationReason == "" {
+		return string(core.InvalidatedBySelf)
+	}
+	return string(target.InvalidationReason)
+}
+
+// rebuildTrigger returns the kind of change that caused a target to be rebuilt, defaulting to
+// unknown if we don't know any better.
+func rebuildTrigger(target *core.BuildTarget) string {
+	if target.RebuildTrigger == "" {
+		return string(core.TriggeredByUnknown)
+	}
+	return string(target.RebuildTrigger)
+}
+
+// execution returns the label describing where the given target was built.
+func execution(target *core.BuildTarget) string {
+	if target.BuiltRemotely {
+		return "remote"
+	}
+	return "local"
+}
+
+// inputFileCount returns the number of input files of the given target; that's all its file
+// sources plus the outputs of its build dependencies (which include any sources that are rules).
+func inputFileCount(target *core.BuildTarget) int {
+	count := 0
+	for _, src := range target.AllSources() {
+		if src.Label() == nil {
+			count++
+		}
+	}
+	for _, dep := range target.BuildDependencies() {
+		count += len(dep.Outputs())
+	}
+	return count
+}
+
+// cacheable returns the label describing whether the given target was a candidate for retrieval
+// from the cache. Filegroups are never stored there, and targets reused unchanged don't check it.
+func cacheable(target *core.BuildTarget) string {
+	return b(!target.IsFilegroup && target.State() != core.Reused)
+}
+
+// sandboxed returns the label describing whether the given target was built in the sandbox.
+// As in core.ExecWithTimeoutShell, sandboxing only takes effect on Linux.
+func sandboxed(target *core.BuildTarget) string {
+	return b(target.Sandbox && runtime.GOOS == "linux")
+}
+
+// observe records a duration in the given histogram, if histograms are enabled.
+// The duration is rounded to the configured precision first, and recorded in the configured unit.
+func (m *metrics) observe(histogram *prometheus.HistogramVec, duration time.Duration, labels ...string) {
+	if histogram != nil {
+		if m.precision > 1 {
+			duration = (duration + m.precision/2) / m.precision * m.precision
+		}
+		histogram.WithLabelValues(labels...).Observe(float64(duration) / float64(m.unit))
+	}
+}
+
+// durationPrecisions maps the allowed values of Metrics.DurationPrecision to the durations they represent.
+var durationPrecisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// durationPrecision returns the duration represented by the given value of Metrics.DurationPrecision.
+// An empty value is treated as the default of full precision; it panics on anything else we don't know about.
+func durationPrecision(value string) time.Duration {
+	if value == "" {
+		return time.Nanosecond
+	}
+	precision, present := durationPrecisions[value]
+	if !present {
+		panic(fmt.Sprintf("Invalid metrics.durationprecision %q, must be one of ns, us, ms or s", value))
+	}
+	return precision
+}
+
+// defaultQuantiles are the quantiles we calculate for summaries if metrics.quantiles isn't set.
+var defaultQuantiles = []string{"0.5:0.05", "0.9:0.01", "0.99:0.001"}
+
+// parseQuantiles parses the metrics.quantiles config setting into the objectives for summaries.
+func parseQuantiles(specs []string) map[float64]float64 {
+	if len(specs) == 0 {
+		specs = defaultQuantiles
+	}
+	objectives := map[float64]float64{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 {
+			panic(fmt.Sprintf("Invalid metrics quantile %s, must be in the form quantile:error", spec))
+		}
+		q, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || q <= 0 || q >= 1 {
+			panic(fmt.Sprintf("Invalid metrics quantile %s, must be between 0 and 1", parts[0]))
+		}
+		e, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || e < 0 || e >= 1 {
+			panic(fmt.Sprintf("Invalid error for metrics quantile %s: %s", parts[0], parts[1]))
+		}
+		objectives[q] = e
+	}
+	return objectives
+}
+
+// durationUnits maps the allowed values of Metrics.DurationUnit to the durations they represent.
+var durationUnits = map[string]time.Duration{
+	"seconds":      time.Second,
+	"milliseconds": time.Millisecond,
+}
+
+// durationUnit returns the duration represented by the given value of Metrics.DurationUnit.
+// An empty value is treated as the default of seconds; it panics on anything else we don't know about.
+func durationUnit(value string) time.Duration {
+	if value == "" {
+		return time.Second
+	}
+	unit, present := durationUnits[value]
+	if !present {
+		panic(fmt.Sprintf("Invalid metrics.durationunit %q, must be seconds or milliseconds", value))
+	}
+	return unit
+}
+
+// bucketWidth scales a histogram bucket width in seconds to the configured duration unit.
+func (m *metrics) bucketWidth(seconds float64) float64 {
+	return seconds * float64(time.Second) / float64(m.unit)
+}
+
+func b(value bool) string {
+	if value {
+		return "true"
+	}
+	return "false"
+}
+
+func (m *metrics) keepPushing() {
+	defer close(m.exited)
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-m.ticker.C():
+			if !m.tick() {
+				return
+			}
+		case <-m.pushNow:
+			if !m.tick() {
+				return
+			}
+		case <-tickerC(m.histogramTicker):
+			m.histogramTick()
+		}
+	}
+}
+
+// tick is called periodically (or when enough records have accumulated) to push metrics.
+// It returns false if we've given up on pushing entirely.
+// It holds m.mutex throughout, which guards the state used while pushing (the samplers, error
+// counts and circuit breaker) since stop() uses it too.
+func (m *metrics) tick() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.cancelled {
+		if m.cooldown <= 0 {
+			return false
+		} else if m.clock.Now().Sub(m.cancelledAt) < m.cooldown {
+			return true
+		}
+		log.Debug("Metrics cooldown has passed, trying again")
+		m.breakerGauge.Set(breakerHalfOpen)
+	}
+	m.sampleQueueDepth()
+	m.sampleMemCache()
+	m.samplePlacements()
+	m.errors = m.pushMetrics(m.timeout)
+	if m.errors == 0 && m.cancelled {
+		log.Debug("Metrics are working again")
+		m.cancelled = false
+		m.breakerGauge.Set(breakerClosed)
+		m.markNew()
+	} else if m.errors >= maxErrors {
+		m.cancel()
+	}
+	return true
+}
+
+// histogramTick pushes the histograms on their own schedule, if they're configured to be.
+// Failures count towards the same limit as tick's, so repeated ones pause pushing in the same way.
+func (m *metrics) histogramTick() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.cancelled {
+		return
+	} else if err := m.pushHistograms(); err != nil {
+		m.lastErr = err
+		if m.errors++; m.errors >= maxErrors {
+			m.cancel()
+		}
+	}
+}
+
+// heartbeat records that the build has started and triggers a push in the background, so even
+// builds that fail very early (e.g. during parsing) leave a trace. It doesn't block.
+func (m *metrics) heartbeat() {
+	m.startedCounter.Inc()
+	m.markNew()
+	select {
+	case m.pushNow <- struct{}{}:
+	default:
+	}
+}
+
+// recorded notes that a target has been recorded, and triggers a push if we've hit metrics.pusheveryn.
+// If a push is already pending this doesn't queue another one.
+func (m *metrics) recorded() {
+	if m.pushEveryN > 0 && atomic.AddInt64(&m.unpushed, 1) >= m.pushEveryN {
+		select {
+		case m.pushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cancel stops pushing metrics after repeated errors. If a cooldown is configured we'll try
+// again once it's passed, otherwise we give up for the rest of the process.
+func (m *metrics) cancel() {
+	if m.cooldown > 0 {
+		log.Warning("Metrics don't seem to be working, pausing for %s", m.cooldown)
+	} else {
+		log.Warning("Metrics don't seem to be working, giving up")
+	}
+	m.cancelled = true
+	m.cancelledAt = m.clock.Now()
+	m.breakerGauge.Set(breakerOpen)
+}
+
+// sampleQueueDepth updates the queue depth gauge, if we have a way of sampling it.
+func (m *metrics) sampleQueueDepth() {
+	if f := m.queueDepth; f != nil {
+		if depth := f(); depth != m.lastQueueDepth {
+			m.queueDepthGauge.Set(float64(depth))
+			m.lastQueueDepth = depth
+			m.markNew()
+		}
+	}
+}
+
+// sampleMemCache updates the in-memory cache counters with any hits & misses since we last sampled them.
+func (m *metrics) sampleMemCache() {
+	if f := m.memCache; f != nil {
+		if hits, misses := f(); hits != m.lastMemCacheHits || misses != m.lastMemCacheMisses {
+			m.memCacheHitCounter.Add(float64(hits - m.lastMemCacheHits))
+			m.memCacheMissCounter.Add(float64(misses - m.lastMemCacheMisses))
+			m.lastMemCacheHits = hits
+			m.lastMemCacheMisses = misses
+			m.markNew()
+		}
+	}
+}
+
+// samplePlacements updates the output placement counter with any files placed since we last sampled it.
+func (m *metrics) samplePlacements() {
+	hardlinks, symlinks, copies := fs.PlacementStats()
+	for i, n := range [3]int64{hardlinks, symlinks, copies} {
+		if n != m.lastPlacements[i] {
+			m.placementCounter.WithLabelValues(placementMethods[i]).Add(float64(n - m.lastPlacements[i]))
+			m.lastPlacements[i] = n
+			m.markNew()
+		}
+	}
+}
+
+// A backend is somewhere that we can send metrics to.
+type backend interface {
+	// Push sends all the metrics collected by the given gatherer.
+	Push(gatherer prometheus.Gatherer) error
+}
+
+// newBackends returns the set of backends that are configured.
+func newBackends(config *core.Configuration) []backend {
+	backends := []backend{}
+	if config.Metrics.PushGatewayURL != "" {
+		backends = append(backends, newPushGateway(config))
+	}
+	if config.Metrics.RemoteWriteURL != "" {
+		backends = append(backends, newRemoteWrite(config))
+	}
+	if config.Metrics.JSONEndpoint != "" {
+		backends = append(backends, newJSONExporter(config))
+	}
+	return backends
+}
+
+// A deleter is a backend that can delete previously pushed metrics.
+type deleter interface {
+	// Delete deletes all the metrics that we've pushed to this backend.
+	Delete() error
+}
+
+// clear deletes any metrics left over from previous builds from all backends that support it.
+// Failures are logged but otherwise ignored, since it's not essential.
+func (m *metrics) clear() {
+	for _, b := range m.backends {
+		if d, ok := b.(deleter); ok {
+			if err := m.deadline(d.Delete, m.timeout); err != nil {
+				log.Warning("Failed to clear existing metrics: %s", err)
+			}
+		}
+	}
+}
+
+// deadline applies a deadline to an arbitrary function and returns when either the function
+// completes or the deadline expires.
+func (m *metrics) deadline(f func() error, timeout time.Duration) error {
+	c := make(chan error)
+	go func() {
+		c <- f()
+	}()
+	select {
+	case err := <-c:
+		return err
+	case <-m.clock.After(timeout):
+		return fmt.Errorf("Metrics push timed out")
+	}
+}
+
+// markNew records that there are new metrics that haven't been pushed yet.
+// It's safe to call from any goroutine.
+func (m *metrics) markNew() {
+	atomic.StoreInt32(&m.newMetrics, 1)
+}
+
+// hasNew returns true if there are new metrics that haven't been pushed yet.
+func (m *metrics) hasNew() bool {
+	return atomic.LoadInt32(&m.newMetrics) != 0
+}
+
+// pushMetrics attempts to send some new metrics to the server within the given timeout.
+// It returns the new number of errors.
+// The caller must hold m.mutex.
+func (m *metrics) pushMetrics(timeout time.Duration) int {
+	if atomic.SwapInt32(&m.newMetrics, 0) == 0 {
+		return m.errors
+	}
+	start := m.clock.Now()
+	atomic.StoreInt64(&m.unpushed, 0)
+	gatherer := m.labelled(m.gatherer)
+	if err := m.deadline(func() error {
+		for _, b := range m.backends {
+			if err := b.Push(gatherer); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, timeout); err != nil {
+		log.Warning("Could not push metrics to the repository: %s", err)
+		m.markNew()
+		m.lastErr = err
+		return m.errors + 1
+	}
+	m.lastErr = nil
+	m.pushes++
+	log.Debug("Push #%d of metrics in %0.3fs", m.pushes, m.clock.Now().Sub(start).Seconds())
+	return 0
+}
+
+// labelled returns the given gatherer with any labels from SetLabels applied.
+func (m *metrics) labelled(g prometheus.Gatherer) prometheus.Gatherer {
+	m.extraLabelsMutex.Lock()
+	defer m.extraLabelsMutex.Unlock()
+	return newLabellingGatherer(g, m.extraLabels)
+}
+
+// pushHistograms pushes the histograms separately from everything else, if they're configured
+// to be pushed on their own schedule and there are new observations since the last push.
+// It returns any error from pushing them.
+func (m *metrics) pushHistograms() error {
+	previous := m.histogramSamples
+	if !m.newHistogramSamples() {
+		return nil
+	}
+	if err := m.deadline(func() error {
+		for _, b := range m.backends {
+			if err := b.Push(m.labelled(m.histogramRegistry)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, m.timeout); err != nil {
+		log.Warning("Could not push histograms to the repository: %s", err)
+		m.histogramSamples = previous // Make sure we try again next time.
+		return err
+	}
+	return nil
+}
+
+// newHistogramSamples returns true if there have been any histogram observations since we last
+// pushed them separately. It updates the recorded count as it goes.
+func (m *metrics) newHistogramSamples() bool {
+	families, err := m.histogramRegistry.Gather()
+	if err != nil {
+		return true
+	}
+	var samples uint64
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			samples += metric.GetHistogram().GetSampleCount()
+		}
+	}
+	if samples == m.histogramSamples {
+		return false
+	}
+	m.histogramSamples = samples
+	return true
+}
+
+// tickerC returns the channel for the given ticker, or nil (which never receives) if it's nil.
+func tickerC(t ticker) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C()
+}
+
+// nextBuildSeq increments the persisted build sequence number and returns the new value.
+// It holds an exclusive flock on the file while doing so, so concurrent plz processes in the
+// same repo won't both get the same number.
+// Failures to read or write it are not fatal; we just won't get a consistent sequence.
+func nextBuildSeq() int {
+	if err := os.MkdirAll(path.Dir(buildSeqFile), core.DirPermissions); err != nil {
+		log.Warning("Failed to create directory for build sequence number: %s", err)
+		return 1
+	}
+	f, err := os.OpenFile(buildSeqFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Warning("Failed to open build sequence number: %s", err)
+		return 1
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		log.Warning("Failed to lock build sequence number: %s", err)
+		return 1
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	seq := 0
+	if b, err := ioutil.ReadAll(f); err != nil {
+		log.Warning("Failed to read build sequence number: %s", err)
+	} else if s := strings.TrimSpace(string(b)); s != "" {
+		if seq, err = strconv.Atoi(s); err != nil {
+			log.Warning("Invalid build sequence number in %s: %s", buildSeqFile, err)
+		}
+	}
+	seq++
+	b := []byte(strconv.Itoa(seq))
+	if _, err := f.WriteAt(b, 0); err != nil {
+		log.Warning("Failed to write build sequence number: %s", err)
+	} else if err := f.Truncate(int64(len(b))); err != nil {
+		log.Warning("Failed to write build sequence number: %s", err)
+	}
+	return seq
+}
+
+// versionSuffix returns the suffix to apply to metric names if they're to include the major version of plz.
+func versionSuffix(enabled bool) string {
+	if enabled {
+		return fmt.Sprintf("_v%d", core.PleaseVersion.Major)
+	}
+	return ""
+}
+
+// gitDirty returns "true" if the git working tree in the given directory has any changes (including
+// untracked files), "false" if it hasn't, or "unknown" if it isn't a git checkout.
+func gitDirty(dir string) string {
+	cmd := core.ExecCommand("git", "status", "--porcelain")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		log.Debug("Can't determine git status for metrics: %s", err)
+		return "unknown"
+	}
+	return b(len(bytes.TrimSpace(out)) > 0)
+}
+
+// gitReleaseTag returns the nearest tag to HEAD of the git repo in the given directory, or the
+// empty string if there isn't one (or it isn't a git repo at all).
+func gitReleaseTag(dir string) string {
+	b, err := runLabelCommand(dir, nil, "git", "describe", "--tags", "--abbrev=0")
+	if err != nil {
+		log.Debug("Can't determine git tag for metrics: %s", err)
+		return ""
+	}
+	return validateLabelValue("git describe", string(b))
+}
+
+// cachePrewarmed returns "true" or "false" if either the environment variable or the given config
+// value say whether the cache was pre-warmed, or "unknown" if neither of them do.
+func cachePrewarmed(value string) string {
+	if env := os.Getenv(cachePrewarmedEnvVar); env != "" {
+		value = env
+	}
+	if prewarmed, err := strconv.ParseBool(value); err == nil {
+		return b(prewarmed)
+	}
+	return "unknown"
+}
+
+// totalMemoryGB returns the total system memory in gigabytes (rounded to the nearest one), or
+// "unknown" if we can't determine it. Currently this is only supported on Linux.
+func totalMemoryGB() string {
+	b, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return "unknown"
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "MemTotal:" {
+			if kb, err := strconv.Atoi(fields[1]); err == nil {
+				return strconv.Itoa((kb + 512*1024) / (1024 * 1024))
+			}
+		}
+	}
+	return "unknown"
+}
+
+// parseRedactions parses the metrics.redactlabels config setting into a map of label names
+// to the patterns that should be redacted from their values.
+func parseRedactions(specs []string) map[string]*regexp.Regexp {
+	redactions := map[string]*regexp.Regexp{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			panic(fmt.Sprintf("Invalid label redaction %s, must be in the form label=regex", spec))
+		}
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			panic(fmt.Sprintf("Invalid regex for redacting label %s: %s", parts[0], err))
+		}
+		redactions[parts[0]] = re
+	}
+	return redactions
+}
+
+// redact replaces any parts of the given label's value that match its redaction pattern.
+func redact(redactions map[string]*regexp.Regexp, name, value string) string {
+	if re, present := redactions[name]; present {
+		return re.ReplaceAllLiteralString(value, "***")
+	}
+	return value
+}
+
+// labelCommandEnv returns the environment that custom label commands are run in.
+// This is deliberately minimal; it contains PATH and any of the given variables that are set.
+func labelCommandEnv(allowed []string) []string {
+	env := []string{}
+	for _, name := range append([]string{"PATH"}, allowed...) {
+		if value, present := os.LookupEnv(name); present {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// deriveLabelValue runs a command in the given environment and returns its output.
 // It returns the empty string on error; we assume it's better to keep the set of labels constant on failure.
-func deriveLabelValue(cmd string) string {
+func deriveLabelValue(cmd string, env []string) string {
 	parts, err := shlex.Split(cmd)
 	if err != nil {
 		panic(fmt.Sprintf("Invalid custom metric command [%s]: %s", cmd, err))
 	}
 	log.Debug("Running custom label command: %s", cmd)
-	b, err := core.ExecCommand(parts[0], parts[1:]...).Output()
-	log.Debug("Got output: %s", b)
+	b, err := runLabelCommand("", env, parts...)
 	if err != nil {
 		panic(fmt.Sprintf("Custom metric command [%s] failed: %s", cmd, err))
 	}
-	value := strings.TrimSpace(string(b))
+	return validateLabelValue(fmt.Sprintf("custom metric command [%s]", cmd), string(b))
+}
+
+// runLabelCommand runs a command to derive the value of a label and returns its output.
+// If dir is empty it's run in the current directory, and if env is nil it inherits ours.
+func runLabelCommand(dir string, env []string, args ...string) ([]byte, error) {
+	c := core.ExecCommand(args[0], args[1:]...)
+	c.Dir = dir
+	c.Env = env
+	b, err := c.Output()
+	log.Debug("Got output: %s", b)
+	return b, err
+}
+
+// validateLabelValue checks that a custom label value is usable and returns it trimmed of whitespace.
+// source describes where the value came from, for error messages.
+func validateLabelValue(source, value string) string {
+	value = strings.TrimSpace(value)
 	if strings.Contains(value, "\n") {
-		panic(fmt.Sprintf("Return value of custom metric command [%s] contains spaces: %s", cmd, value))
+		panic(fmt.Sprintf("Return value of %s contains newlines: %s", source, value))
 	}
 	return value
 }
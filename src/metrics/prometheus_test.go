@@ -1,12 +1,30 @@
 package metrics
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 
+	"cli"
+
 	"core"
+	"fs"
 )
 
 const url = "http://localhost:9999"
@@ -16,7 +34,7 @@ const timeout = 10000000  // Long timeout so it doesn't affect things
 var label = core.BuildLabel{PackageName: "src/metrics", Name: "prometheus"}
 
 func TestNoMetrics(t *testing.T) {
-	m := initMetrics(url, verySlow, timeout, nil, true)
+	m := initMetrics(makeConfig(verySlow, timeout, nil, true))
 	assert.Equal(t, 0, m.errors)
 	assert.Equal(t, 0, m.pushes)
 	m.stop()
@@ -24,95 +42,1081 @@ func TestNoMetrics(t *testing.T) {
 }
 
 func TestSomeMetrics(t *testing.T) {
-	m := initMetrics(url, verySlow, timeout, nil, true)
+	m := initMetrics(makeConfig(verySlow, timeout, nil, true))
 	assert.Equal(t, 0, m.errors)
 	assert.Equal(t, 0, m.pushes)
-	m.record(core.NewBuildTarget(label), time.Millisecond)
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
 	m.stop()
 	assert.Equal(t, 1, m.errors, "Stop should push once more when there are metrics")
 }
 
+func TestStopReturnsError(t *testing.T) {
+	m := initMetrics(makeConfig(verySlow, timeout, nil, true))
+	assert.NoError(t, m.stop(), "Nothing to push so it can't fail")
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	assert.Error(t, m.stop())
+	assert.Error(t, m.stop(), "Should still report the failure when called again")
+}
+
 func TestTargetStates(t *testing.T) {
-	m := initMetrics(url, verySlow, timeout, nil, true)
+	m := initMetrics(makeConfig(verySlow, timeout, nil, true))
 	assert.Equal(t, 0, m.errors)
 	assert.Equal(t, 0, m.pushes)
 	target := core.NewBuildTarget(label)
-	m.record(target, time.Millisecond)
+	m.record(context.Background(), target, time.Millisecond)
 	target.SetState(core.Cached)
-	m.record(target, time.Millisecond)
+	m.record(context.Background(), target, time.Millisecond)
 	target.SetState(core.Built)
-	m.record(target, time.Millisecond)
+	m.record(context.Background(), target, time.Millisecond)
 	target.Results.NumTests = 3
-	m.record(target, time.Millisecond)
+	m.record(context.Background(), target, time.Millisecond)
 	target.Results.Failed = 1
-	m.record(target, time.Millisecond)
+	m.record(context.Background(), target, time.Millisecond)
 	target.Results.Cached = true
-	m.record(target, time.Millisecond)
+	m.record(context.Background(), target, time.Millisecond)
 	m.stop()
 	assert.Equal(t, 1, m.errors)
 }
 
+func TestTestHistograms(t *testing.T) {
+	m := initMetricsWithClock(makeConfig(verySlow, timeout, nil, false), newFakeClock())
+	target := core.NewBuildTarget(label)
+	target.Results.NumTests = 3
+	m.record(context.Background(), target, time.Second)
+	target.Results.Cached = true
+	m.record(context.Background(), target, 2*time.Second)
+	target.Results.Cached = false
+	target.Results.Failed = 1
+	m.record(context.Background(), target, 4*time.Second)
+	summary, err := summarise(m.registry, m.constLabels)
+	assert.NoError(t, err)
+	assert.Contains(t, summary, "test_durations_histogram{cached=false}:count=1")
+	assert.Contains(t, summary, "test_durations_histogram{cached=false}:sum=1")
+	assert.Contains(t, summary, "test_durations_histogram{cached=true}:count=1")
+	assert.Contains(t, summary, "test_durations_histogram{cached=true}:sum=2")
+	assert.Contains(t, summary, "test_case_count_histogram:count=3")
+	assert.Contains(t, summary, "test_case_count_histogram:sum=9")
+	assert.NotContains(t, summary, "cache_durations_histogram", "Cached tests go in the test histogram")
+	assert.NotContains(t, summary, "build_durations_histogram")
+}
+
+func TestTestHistogramsPerTest(t *testing.T) {
+	m := initMetricsWithClock(makeConfig(verySlow, timeout, nil, true), newFakeClock())
+	target := core.NewBuildTarget(label)
+	target.Results.NumTests = 3
+	m.record(context.Background(), target, time.Second)
+	summary, err := summarise(m.registry, m.constLabels)
+	assert.NoError(t, err)
+	assert.Contains(t, summary, "test_durations_histogram{cached=false,test=//src/metrics:prometheus}:count=1")
+	assert.Contains(t, summary, "test_case_count_histogram{test=//src/metrics:prometheus}:count=1")
+}
+
+func TestTestCached(t *testing.T) {
+	m := initMetricsWithClock(makeConfig(verySlow, timeout, nil, false), newFakeClock())
+	target := core.NewBuildTarget(label)
+	target.Results.NumTests = 3
+	m.record(context.Background(), target, time.Millisecond)
+	m.record(context.Background(), target, time.Millisecond)
+	target.Results.Cached = true
+	m.record(context.Background(), target, time.Millisecond)
+	summary, err := summarise(m.registry, m.constLabels)
+	assert.NoError(t, err)
+	assert.Contains(t, summary, "test_cached_total{cached=false}=2")
+	assert.Contains(t, summary, "test_cached_total{cached=true}=1")
+	assert.Contains(t, summary, "cache_hits{cacheable=true,hit=false}=2")
+	assert.Contains(t, summary, "cache_hits{cacheable=true,hit=true}=1")
+}
+
 func TestPushAttempts(t *testing.T) {
-	m := initMetrics(url, 1, 1000, nil, true) // Fast push attempts
+	m := initMetrics(makeConfig(1, 1000, nil, true)) // Fast push attempts
 	assert.Equal(t, 0, m.errors)
 	assert.Equal(t, 0, m.pushes)
-	m.record(core.NewBuildTarget(label), time.Millisecond)
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
 	time.Sleep(50 * time.Millisecond) // Not ideal but should be heaps of time for it to attempt pushes.
+	m.mutex.Lock()
 	assert.Equal(t, maxErrors, m.errors)
 	assert.True(t, m.cancelled)
+	m.mutex.Unlock()
 	m.stop()
 	assert.Equal(t, maxErrors, m.errors, "Should not push again if it's hit the max errors")
 }
 
+func TestPushEveryN(t *testing.T) {
+	config := makeConfig(time.Hour, timeout, nil, true)
+	config.Metrics.PushEveryN = 2
+	m := initMetrics(config)
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	m.mutex.Lock()
+	assert.Equal(t, 0, m.errors, "Shouldn't push after only one record")
+	m.mutex.Unlock()
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	m.mutex.Lock()
+	assert.Equal(t, 1, m.errors, "Should have attempted a push after the second")
+	m.mutex.Unlock()
+	m.stop()
+}
+
+func TestPushCooldown(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, true)
+	config.Metrics.Cooldown = cli.Duration(time.Minute)
+	clock := newFakeClock()
+	m := initMetricsWithClock(config, clock)
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	for i := 0; i < maxErrors; i++ {
+		assert.True(t, m.tick())
+	}
+	assert.True(t, m.cancelled)
+	assert.Equal(t, maxErrors, m.errors)
+	m.backends = nil // Now pushes will succeed again
+	clock.Advance(30 * time.Second)
+	assert.True(t, m.tick())
+	assert.True(t, m.cancelled, "Shouldn't try again until the cooldown has passed")
+	assert.Equal(t, maxErrors, m.errors)
+	clock.Advance(30 * time.Second)
+	assert.True(t, m.tick())
+	assert.False(t, m.cancelled, "Should have recovered after the cooldown")
+	assert.Equal(t, 0, m.errors)
+	m.stop()
+}
+
+func TestHistogramPushFrequency(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.HistogramPushFrequency = cli.Duration(time.Minute)
+	m := initMetricsWithClock(config, newFakeClock())
+	b := &recordingBackend{}
+	m.backends = []backend{b}
+	target := core.NewBuildTarget(label)
+	target.SetState(core.Built)
+	m.record(context.Background(), target, time.Millisecond)
+	m.tick()
+	assert.Contains(t, b.names, "build_counts")
+	assert.NotContains(t, b.names, "build_durations_histogram")
+	m.pushHistograms()
+	assert.Contains(t, b.names, "build_durations_histogram")
+	assert.NotContains(t, b.names, "build_counts")
+	m.pushHistograms()
+	assert.Equal(t, 2, b.pushes, "Shouldn't push histograms again when there are no new observations")
+	m.record(context.Background(), target, time.Millisecond)
+	m.stop()
+	assert.Contains(t, b.names, "build_counts", "Final push should include everything")
+	assert.Contains(t, b.names, "build_durations_histogram", "Final push should include everything")
+}
+
+func TestHistogramPushErrors(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.HistogramPushFrequency = cli.Duration(time.Minute)
+	config.Metrics.Cooldown = cli.Duration(time.Minute)
+	m := initMetricsWithClock(config, newFakeClock())
+	target := core.NewBuildTarget(label)
+	target.SetState(core.Built)
+	m.record(context.Background(), target, time.Millisecond)
+	for i := 0; i < maxErrors; i++ {
+		m.histogramTick()
+	}
+	assert.True(t, m.cancelled, "Failed histogram pushes should trip the breaker")
+	assert.Equal(t, maxErrors, m.errors)
+	assert.Error(t, m.lastErr)
+	m.histogramTick()
+	assert.Equal(t, maxErrors, m.errors, "Shouldn't push histograms while cancelled")
+	m.stop()
+}
+
+func TestPushNoCooldown(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, true)
+	config.Metrics.Cooldown = 0
+	m := initMetricsWithClock(config, newFakeClock())
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	for i := 0; i < maxErrors; i++ {
+		assert.True(t, m.tick())
+	}
+	assert.False(t, m.tick(), "Should give up entirely once cancelled")
+	m.stop()
+}
+
+func TestStopTerminatesPushing(t *testing.T) {
+	m := initMetrics(makeConfig(verySlow, timeout, nil, true))
+	go m.stop()
+	select {
+	case <-m.exited:
+	case <-time.After(time.Second):
+		t.Fatal("keepPushing goroutine did not terminate after stop()")
+	}
+}
+
 func TestCustomLabels(t *testing.T) {
-	m := initMetrics(url, verySlow, timeout, map[string]string{
+	m := initMetrics(makeConfig(verySlow, timeout, map[string]string{
 		"mylabel": "echo hello",
-	}, true)
+	}, true))
 	// It's a little bit fiddly to observe that the const label has been set as expected.
-	c := m.cacheCounter.WithLabelValues("false")
+	c := m.cacheCounter.WithLabelValues("false", "true")
 	assert.Contains(t, c.Desc().String(), `mylabel="hello"`)
 }
 
 func TestCustomLabelsShlex(t *testing.T) {
 	// Naive splitting will not produce good results here.
-	m := initMetrics(url, verySlow, timeout, map[string]string{
+	m := initMetrics(makeConfig(verySlow, timeout, map[string]string{
 		"mylabel": "bash -c 'echo hello'",
-	}, false)
-	c := m.cacheCounter.WithLabelValues("false")
+	}, false))
+	c := m.cacheCounter.WithLabelValues("false", "true")
 	assert.Contains(t, c.Desc().String(), `mylabel="hello"`)
 }
 
+func TestCustomLabelsEnvironment(t *testing.T) {
+	os.Setenv("METRICS_TEST_ALLOWED", "allowed")
+	os.Setenv("METRICS_TEST_HIDDEN", "hidden")
+	config := makeConfig(verySlow, timeout, map[string]string{
+		"allowed": "bash -c 'echo ${METRICS_TEST_ALLOWED:-missing}'",
+		"hidden":  "bash -c 'echo ${METRICS_TEST_HIDDEN:-missing}'",
+	}, false)
+	config.Metrics.LabelCommandEnv = []string{"METRICS_TEST_ALLOWED"}
+	m := initMetrics(config)
+	desc := m.cacheCounter.WithLabelValues("false", "true").Desc().String()
+	assert.Contains(t, desc, `allowed="allowed"`)
+	assert.Contains(t, desc, `hidden="missing"`)
+}
+
+func TestTags(t *testing.T) {
+	config := makeConfig(verySlow, timeout, map[string]string{
+		"mylabel": "echo hello",
+	}, false)
+	config.Metrics.Tags = []string{"mylabel=goodbye", "other=a=b"}
+	m := initMetrics(config)
+	desc := m.cacheCounter.WithLabelValues("false", "true").Desc().String()
+	assert.Contains(t, desc, `mylabel="goodbye"`)
+	assert.Contains(t, desc, `other="a=b"`)
+}
+
+func TestTagsInvalid(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.Tags = []string{"mylabel"}
+	assert.Panics(t, func() { initMetrics(config) })
+}
+
 func TestCustomLabelsShlexInvalid(t *testing.T) {
 	assert.Panics(t, func() {
-		initMetrics(url, verySlow, timeout, map[string]string{
+		initMetrics(makeConfig(verySlow, timeout, map[string]string{
 			"mylabel": "bash -c 'echo hello", // missing trailing quote
-		}, false)
+		}, false))
 	})
 }
 
 func TestCustomLabelsCommandFails(t *testing.T) {
 	assert.Panics(t, func() {
-		initMetrics(url, verySlow, timeout, map[string]string{
+		initMetrics(makeConfig(verySlow, timeout, map[string]string{
 			"mylabel": "wibble",
-		}, false)
+		}, false))
 	})
 }
 
 func TestCustomLabelsCommandNewlines(t *testing.T) {
 	assert.Panics(t, func() {
-		initMetrics(url, verySlow, timeout, map[string]string{
+		initMetrics(makeConfig(verySlow, timeout, map[string]string{
 			"mylabel": "echo 'hello\nworld\n'",
-		}, true)
+		}, true))
 	})
 }
 
+func TestMetricPrefixAndRenames(t *testing.T) {
+	config := makeConfig(verySlow, timeout, map[string]string{
+		"mylabel": "echo hello",
+	}, false)
+	config.Metrics.MetricPrefix = "plz_"
+	config.MetricLabelRenames = map[string]string{"mylabel": "yourlabel"}
+	m := initMetrics(config)
+	desc := m.cacheCounter.WithLabelValues("false", "true").Desc().String()
+	assert.Contains(t, desc, `"plz_cache_hits"`)
+	assert.Contains(t, desc, `yourlabel="hello"`)
+	assert.NotContains(t, desc, "mylabel")
+}
+
+func TestVersionSuffix(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.MetricPrefix = "plz_"
+	config.Metrics.VersionSuffix = true
+	m := initMetrics(config)
+	families, err := m.registry.Gather()
+	assert.NoError(t, err)
+	names := []string{}
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	assert.Contains(t, names, fmt.Sprintf("plz_build_queue_depth_v%d", core.PleaseVersion.Major))
+}
+
+func TestRedactLabels(t *testing.T) {
+	config := makeConfig(verySlow, timeout, map[string]string{
+		"branch": "echo feature/JIRA-1234-thing",
+	}, true)
+	config.Metrics.RedactLabels = []string{"branch=[A-Z]+-[0-9]+", "test=secret"}
+	m := initMetrics(config)
+	assert.Contains(t, m.cacheCounter.WithLabelValues("false", "true").Desc().String(), `branch="feature/***-thing"`)
+	assert.Equal(t, "//src/***:x", redact(m.redactions, "test", "//src/secret:x"))
+	assert.Equal(t, "//src/secret:x", redact(m.redactions, "rule", "//src/secret:x"))
+}
+
+func TestRedactLabelsInvalid(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, true)
+	config.Metrics.RedactLabels = []string{"branch=[A-Z"}
+	assert.Panics(t, func() { initMetrics(config) })
+}
+
+func TestBuildSeq(t *testing.T) {
+	defer useTempBuildSeqFile(t)()
+	assert.Equal(t, 1, nextBuildSeq())
+	assert.Equal(t, 2, nextBuildSeq())
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.BuildSequence = true
+	m := initMetrics(config)
+	summary, err := summarise(m.registry, m.constLabels)
+	assert.NoError(t, err)
+	assert.Contains(t, summary, "build_sequence_number=3")
+	assert.NotContains(t, m.cacheCounter.WithLabelValues("false", "true").Desc().String(), "build_seq")
+}
+
+func TestBuildSeqDisabled(t *testing.T) {
+	defer useTempBuildSeqFile(t)()
+	m := initMetrics(makeConfig(verySlow, timeout, nil, false))
+	summary, err := summarise(m.registry, m.constLabels)
+	assert.NoError(t, err)
+	assert.NotContains(t, summary, "build_sequence_number")
+	_, err = os.Stat(buildSeqFile)
+	assert.True(t, os.IsNotExist(err), "Shouldn't touch the sequence file unless it's enabled")
+}
+
+func TestBuildSeqLocked(t *testing.T) {
+	defer useTempBuildSeqFile(t)()
+	assert.Equal(t, 1, nextBuildSeq())
+	// Hold the lock as another plz process would; nextBuildSeq should wait until it's released.
+	f, err := os.OpenFile(buildSeqFile, os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, syscall.Flock(int(f.Fd()), syscall.LOCK_EX))
+	seq := make(chan int)
+	go func() { seq <- nextBuildSeq() }()
+	select {
+	case <-seq:
+		assert.Fail(t, "nextBuildSeq didn't wait for the lock")
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, ioutil.WriteFile(buildSeqFile, []byte("5"), 0644))
+	assert.NoError(t, syscall.Flock(int(f.Fd()), syscall.LOCK_UN))
+	assert.Equal(t, 6, <-seq)
+}
+
+// useTempBuildSeqFile points buildSeqFile at a temporary directory so tests don't touch the real
+// one in plz-out. It returns a function that restores it.
+func useTempBuildSeqFile(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "build_seq_test")
+	assert.NoError(t, err)
+	original := buildSeqFile
+	buildSeqFile = path.Join(dir, core.OutDir, ".metrics_build_seq")
+	return func() {
+		buildSeqFile = original
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMaxParallel(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Please.NumThreads = 7
+	m := initMetrics(config)
+	assert.Contains(t, m.cacheCounter.WithLabelValues("false", "true").Desc().String(), `max_parallel="7"`)
+}
+
+func TestHardwareLabels(t *testing.T) {
+	m := initMetrics(makeConfig(verySlow, timeout, nil, false))
+	assert.NotContains(t, m.cacheCounter.WithLabelValues("false", "true").Desc().String(), "cpu_count")
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.IncludeHardwareLabels = true
+	m = initMetrics(config)
+	desc := m.cacheCounter.WithLabelValues("false", "true").Desc().String()
+	assert.Contains(t, desc, fmt.Sprintf(`cpu_count="%d"`, runtime.NumCPU()))
+	assert.Contains(t, desc, "mem_gb=")
+}
+
+func TestSampled(t *testing.T) {
+	assert.True(t, sampled(100, ""))
+	assert.True(t, sampled(0, ""), "Zero means it's unset")
+	assert.True(t, sampled(0, "job-1234"))
+	assert.True(t, sampled((&core.Configuration{}).Metrics.EnabledPercent, ""), "A bare config should still record metrics")
+	assert.False(t, sampled(1, "job-1234"))
+	assert.Equal(t, sampled(50, "job-1234"), sampled(50, "job-1234"), "Should be consistent for the same seed")
+	n := 0
+	for i := 0; i < 1000; i++ {
+		if sampled(10, strconv.Itoa(i)) {
+			n++
+		}
+	}
+	assert.True(t, n > 50 && n < 150, "Expected about 10%% of seeds to be sampled, got %d", n)
+}
+
+func TestDisableEnvVar(t *testing.T) {
+	// This returns before touching the global singleton, so it doesn't interfere with TestExportedFunctions.
+	os.Setenv(disableEnvVar, "1")
+	defer os.Unsetenv(disableEnvVar)
+	before := m
+	registry := prometheus.NewRegistry()
+	InitWithRegisterer(makeConfig(verySlow, timeout, nil, false), 1, registry)
+	assert.True(t, m == before, "Metrics shouldn't have been initialised")
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(families))
+	os.Setenv(disableEnvVar, "false")
+	assert.False(t, disabledByEnv())
+	os.Setenv(disableEnvVar, "0")
+	assert.False(t, disabledByEnv())
+	os.Setenv(disableEnvVar, "yes please")
+	assert.True(t, disabledByEnv(), "Unparsable values should disable metrics")
+	os.Unsetenv(disableEnvVar)
+	assert.False(t, disabledByEnv())
+}
+
+func TestInvoker(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.Invoker = "plzw"
+	m := initMetrics(config)
+	assert.Contains(t, m.cacheCounter.WithLabelValues("false", "true").Desc().String(), `invoker="plzw"`)
+	os.Setenv(invokerEnvVar, "bazel_shim")
+	defer os.Unsetenv(invokerEnvVar)
+	m = initMetrics(config)
+	assert.Contains(t, m.cacheCounter.WithLabelValues("false", "true").Desc().String(), `invoker="bazel_shim"`)
+}
+
+func TestCachePrewarmed(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	m := initMetrics(config)
+	assert.Contains(t, m.cacheCounter.WithLabelValues("false", "true").Desc().String(), `cache_prewarmed="unknown"`)
+	config.Metrics.CachePrewarmed = "false"
+	m = initMetrics(config)
+	assert.Contains(t, m.cacheCounter.WithLabelValues("false", "true").Desc().String(), `cache_prewarmed="false"`)
+	os.Setenv(cachePrewarmedEnvVar, "1")
+	defer os.Unsetenv(cachePrewarmedEnvVar)
+	m = initMetrics(config)
+	assert.Contains(t, m.cacheCounter.WithLabelValues("false", "true").Desc().String(), `cache_prewarmed="true"`)
+}
+
+func TestGitDirty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git_dirty_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, "unknown", gitDirty(dir))
+	if err := exec.Command("git", "init", dir).Run(); err != nil {
+		t.Skipf("Can't create a git repo: %s", err)
+	}
+	assert.Equal(t, "false", gitDirty(dir))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("hello"), 0644))
+	assert.Equal(t, "true", gitDirty(dir))
+}
+
+func TestGitReleaseTag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git_release_tag_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, "", gitReleaseTag(dir))
+	git := func(args ...string) error {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=plz", "-c", "user.email=plz@example.com"}, args...)...)
+		cmd.Dir = dir
+		return cmd.Run()
+	}
+	if err := git("init"); err != nil {
+		t.Skipf("Can't create a git repo: %s", err)
+	}
+	assert.NoError(t, git("commit", "--allow-empty", "-m", "initial"))
+	assert.Equal(t, "", gitReleaseTag(dir))
+	assert.NoError(t, git("tag", "v1.2.3"))
+	assert.NoError(t, git("commit", "--allow-empty", "-m", "second"))
+	assert.Equal(t, "v1.2.3", gitReleaseTag(dir))
+}
+
+func TestDisableHistograms(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, true)
+	config.Metrics.DisableHistograms = true
+	m := initMetrics(config)
+	assert.Nil(t, m.buildHistogram)
+	for _, c := range m.collectors() {
+		_, isHistogram := c.(*prometheus.HistogramVec)
+		assert.False(t, isHistogram)
+	}
+	target := core.NewBuildTarget(label)
+	target.SetState(core.Built)
+	m.record(context.Background(), target, time.Millisecond)
+	target.Results.NumTests = 3
+	m.record(context.Background(), target, time.Millisecond)
+	m.stop()
+	assert.Equal(t, 1, m.errors)
+}
+
+func TestSlowThreshold(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, true)
+	config.Metrics.SlowThreshold = cli.Duration(time.Second)
+	m := initMetrics(config)
+	fast := core.NewBuildTarget(core.BuildLabel{PackageName: "src/metrics", Name: "fast"})
+	slow := core.NewBuildTarget(core.BuildLabel{PackageName: "src/metrics", Name: "slow"})
+	failed := core.NewBuildTarget(core.BuildLabel{PackageName: "src/metrics", Name: "failed"})
+	assert.Equal(t, "", m.perTargetLabel("test", fast, time.Millisecond, false))
+	assert.Equal(t, "//src/metrics:slow", m.perTargetLabel("test", slow, 2*time.Second, false))
+	assert.Equal(t, "//src/metrics:failed", m.perTargetLabel("test", failed, time.Millisecond, true))
+	m.slowAfter = 0
+	assert.Equal(t, "//src/metrics:fast", m.perTargetLabel("test", fast, time.Millisecond, false))
+}
+
+func TestPerTestGranularity(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, true)
+	config.Metrics.PerTestGranularity = "suite"
+	m := initMetrics(config)
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "src/metrics", Name: "prometheus_test"})
+	assert.Equal(t, "//src/metrics", m.perTargetLabel("test", target, time.Millisecond, false))
+	config.Metrics.PerTestGranularity = "target"
+	m = initMetrics(config)
+	assert.Equal(t, "//src/metrics:prometheus_test", m.perTargetLabel("test", target, time.Millisecond, false))
+}
+
+func TestInvalidPerTestGranularity(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, true)
+	config.Metrics.PerTestGranularity = "package"
+	assert.Panics(t, func() { initMetrics(config) })
+}
+
+func TestDetailedTargets(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.SlowThreshold = cli.Duration(time.Hour)
+	config.Metrics.DetailedTargets = []core.BuildLabel{core.ParseBuildLabel("//src/metrics:all", "")}
+	m := initMetrics(config)
+	assert.True(t, m.perTest)
+	detailed := core.NewBuildTarget(core.BuildLabel{PackageName: "src/metrics", Name: "prometheus_test"})
+	other := core.NewBuildTarget(core.BuildLabel{PackageName: "src/core", Name: "core_test"})
+	assert.Equal(t, "//src/metrics:prometheus_test", m.perTargetLabel("test", detailed, time.Millisecond, false))
+	assert.Equal(t, "", m.perTargetLabel("test", other, time.Millisecond, true))
+
+	detailed.SetState(core.Built)
+	other.SetState(core.Built)
+	m.record(context.Background(), detailed, time.Millisecond)
+	m.record(context.Background(), other, time.Millisecond)
+	metric := &dto.Metric{}
+	assert.NoError(t, m.buildHistogram.WithLabelValues(execution(detailed), sandboxed(detailed), "//src/metrics:prometheus_test").(prometheus.Histogram).Write(metric))
+	assert.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+	assert.NoError(t, m.buildHistogram.WithLabelValues(execution(other), sandboxed(other), "").(prometheus.Histogram).Write(metric))
+	assert.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+}
+
+func TestPerTestClass(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.PerTestClass = true
+	m := initMetrics(config)
+	target := core.NewBuildTarget(label)
+	target.Results.NumTests = 3
+	target.Results.Results = []core.TestResult{
+		{Name: "testOne", ClassName: "com.example.FooTest", Success: true},
+		{Name: "testTwo", ClassName: "com.example.FooTest"},
+		{Name: "testThree", ClassName: "com.example.BarTest", Success: true},
+		{Name: "test_four", Success: true},
+	}
+	m.record(context.Background(), target, time.Millisecond)
+	metric := &dto.Metric{}
+	assert.NoError(t, m.testClassCounter.WithLabelValues("com.example.FooTest", "true").Write(metric))
+	assert.Equal(t, 1.0, metric.GetCounter().GetValue())
+	assert.NoError(t, m.testClassCounter.WithLabelValues("com.example.FooTest", "false").Write(metric))
+	assert.Equal(t, 1.0, metric.GetCounter().GetValue())
+	assert.NoError(t, m.testClassCounter.WithLabelValues("com.example.BarTest", "true").Write(metric))
+	assert.Equal(t, 1.0, metric.GetCounter().GetValue())
+}
+
+func TestCoverage(t *testing.T) {
+	m := initMetrics(makeConfig(verySlow, timeout, nil, true))
+	target := core.NewBuildTarget(label)
+	target.Results.NumTests = 3
+	target.Results.CoveredLines = 3
+	target.Results.CoverableLines = 4
+	m.record(context.Background(), target, time.Millisecond)
+	ch := make(chan prometheus.Metric, 1)
+	m.coverageGauge.Collect(ch)
+	metric := &dto.Metric{}
+	assert.NoError(t, (<-ch).Write(metric))
+	assert.Equal(t, 0.75, metric.GetGauge().GetValue())
+}
+
+func TestEventLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "events")
+	assert.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.EventLog = f.Name()
+	m := initMetrics(config)
+	target := core.NewBuildTarget(label)
+	m.emit(&Event{Type: "start", Label: target.Label.String()})
+	target.SetState(core.Built)
+	target.RuleHash = []byte{0xca, 0xfe}
+	m.record(context.Background(), target, time.Second)
+	m.stop()
+	b, err := ioutil.ReadFile(f.Name())
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Equal(t, 2, len(lines))
+	event := Event{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal(t, "finish", event.Type)
+	assert.Equal(t, "//src/metrics:prometheus", event.Label)
+	assert.Equal(t, 1.0, event.Duration)
+	assert.Equal(t, "cafe", event.RuleHash)
+}
+
+func TestLogCacheKeys(t *testing.T) {
+	f, err := ioutil.TempFile("", "events")
+	assert.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.EventLog = f.Name()
+	config.Metrics.LogCacheKeys = true
+	m := initMetrics(config)
+	m.recordCacheMiss(core.NewBuildTarget(label), []byte{0xde, 0xad, 0xbe, 0xef})
+	m.stop()
+	b, err := ioutil.ReadFile(f.Name())
+	assert.NoError(t, err)
+	event := Event{}
+	assert.NoError(t, json.Unmarshal(b, &event))
+	assert.Equal(t, "cache_miss", event.Type)
+	assert.Equal(t, "3q2-7w", event.CacheKey)
+}
+
+func TestDurationPrecision(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.DurationPrecision = "ms"
+	m := initMetrics(config)
+	target := core.NewBuildTarget(label)
+	target.SetState(core.Built)
+	m.record(context.Background(), target, 1234567*time.Nanosecond)
+	ch := make(chan prometheus.Metric, 1)
+	m.buildHistogram.Collect(ch)
+	metric := &dto.Metric{}
+	assert.NoError(t, (<-ch).Write(metric))
+	assert.Equal(t, 0.001, metric.GetHistogram().GetSampleSum())
+}
+
+func TestMinObservedDuration(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.MinObservedDuration = cli.Duration(10 * time.Millisecond)
+	m := initMetrics(config)
+	target := core.NewBuildTarget(label)
+	target.SetState(core.Built)
+	m.record(context.Background(), target, time.Millisecond)
+	m.record(context.Background(), target, 20*time.Millisecond)
+	ch := make(chan prometheus.Metric, 1)
+	m.buildHistogram.Collect(ch)
+	metric := &dto.Metric{}
+	assert.NoError(t, (<-ch).Write(metric))
+	assert.Equal(t, uint64(1), metric.GetHistogram().GetSampleCount())
+	m.buildCounter.Collect(ch)
+	assert.NoError(t, (<-ch).Write(metric))
+	assert.Equal(t, 2.0, metric.GetCounter().GetValue(), "Short builds should still be counted")
+}
+
+func TestEmptyDurationPrecision(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.DurationPrecision = ""
+	m := initMetrics(config)
+	assert.Equal(t, time.Nanosecond, m.precision)
+}
+
+func TestInvalidDurationPrecision(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.DurationPrecision = "millis"
+	assert.Panics(t, func() { initMetrics(config) })
+}
+
+func TestDurationUnit(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.DurationUnit = "milliseconds"
+	m := initMetrics(config)
+	target := core.NewBuildTarget(label)
+	target.SetState(core.Built)
+	m.record(context.Background(), target, 1500*time.Microsecond)
+	ch := make(chan prometheus.Metric, 1)
+	m.buildHistogram.Collect(ch)
+	metric := &dto.Metric{}
+	assert.NoError(t, (<-ch).Write(metric))
+	assert.Equal(t, 1.5, metric.GetHistogram().GetSampleSum())
+	assert.Equal(t, 100.0, metric.GetHistogram().Bucket[1].GetUpperBound())
+}
+
+func TestEmptyDurationUnit(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.DurationUnit = ""
+	m := initMetrics(config)
+	assert.Equal(t, time.Second, m.unit)
+}
+
+func TestInvalidDurationUnit(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.DurationUnit = "secs"
+	assert.Panics(t, func() { initMetrics(config) })
+}
+
+func TestQuantiles(t *testing.T) {
+	m := initMetrics(makeConfig(verySlow, timeout, nil, false))
+	assert.Equal(t, map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}, m.objectives)
+	assert.Equal(t, map[float64]float64{0.999: 0.0001}, parseQuantiles([]string{"0.999:0.0001"}))
+	assert.Panics(t, func() { parseQuantiles([]string{"0.5"}) })
+	assert.Panics(t, func() { parseQuantiles([]string{"1:0.01"}) })
+	assert.Panics(t, func() { parseQuantiles([]string{"0:0.01"}) })
+	assert.Panics(t, func() { parseQuantiles([]string{"0.5:-1"}) })
+}
+
+func TestQueueDepth(t *testing.T) {
+	m := initMetricsWithClock(makeConfig(verySlow, timeout, nil, false), newFakeClock())
+	m.queueDepth = func() int { return 5 }
+	m.sampleQueueDepth()
+	assert.True(t, m.hasNew())
+	assert.Equal(t, 5, m.lastQueueDepth)
+	m.newMetrics = 0
+	m.sampleQueueDepth()
+	assert.False(t, m.hasNew(), "Should not need to push again when the depth hasn't changed")
+	m.stop()
+	assert.Nil(t, m.queueDepth)
+}
+
+func TestUnusedTargets(t *testing.T) {
+	graph := core.NewGraph()
+	add := func(name string, state core.BuildTargetState, deps ...string) *core.BuildTarget {
+		target := core.NewBuildTarget(core.BuildLabel{PackageName: "src/metrics", Name: name})
+		target.SetState(state)
+		graph.AddTarget(target)
+		for _, dep := range deps {
+			label := core.BuildLabel{PackageName: "src/metrics", Name: dep}
+			target.AddDependency(label)
+			graph.AddDependency(target.Label, label)
+		}
+		return target
+	}
+	add("dep", core.Built)
+	add("cached_dep", core.Cached)
+	goal := add("goal", core.Built, "dep", "cached_dep")
+	add("unused", core.Built)
+	add("unused_cached", core.Cached)
+	add("inactive", core.Inactive)
+	add("reused", core.Reused)
+	assert.Equal(t, 2, unusedTargets(graph, core.BuildLabels{goal.Label}))
+	assert.Equal(t, 5, unusedTargets(graph, nil))
+	// Tools and subincludes are needed even though nothing depends on them in the graph.
+	tool := add("tool", core.Built)
+	goal.AddTool(tool.Label)
+	subinclude := add("build_defs", core.Built)
+	pkg := core.NewPackage("src/metrics")
+	pkg.RegisterSubinclude(subinclude.Label)
+	graph.AddPackage(pkg)
+	assert.Equal(t, 2, unusedTargets(graph, core.BuildLabels{goal.Label}))
+	assert.Equal(t, 6, unusedTargets(graph, nil))
+}
+
+func TestInputFileCount(t *testing.T) {
+	graph := core.NewGraph()
+	dep := core.NewBuildTarget(core.BuildLabel{PackageName: "src/metrics", Name: "dep"})
+	dep.AddOutput("a.go")
+	dep.AddOutput("b.go")
+	graph.AddTarget(dep)
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "src/metrics", Name: "target"})
+	target.AddSource(core.FileLabel{File: "main.go", Package: "src/metrics"})
+	target.AddSource(dep.Label)
+	graph.AddTarget(target)
+	target.AddDependency(dep.Label)
+	graph.AddDependency(target.Label, dep.Label)
+	assert.Equal(t, 3, inputFileCount(target))
+}
+
+func TestPushOnlyOnExit(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.PushFrequency = cli.Duration(time.Millisecond)
+	config.Metrics.PushOnlyOnExit = true
+	m := initMetrics(config)
+	b := &recordingBackend{}
+	m.backends = []backend{b}
+	m.heartbeat()
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, b.pushes, "Shouldn't push before stopping")
+	assert.NoError(t, m.stop())
+	assert.Equal(t, 1, b.pushes)
+}
+
+func TestMaxStopWait(t *testing.T) {
+	config := makeConfig(time.Hour, timeout, nil, false) // Nothing's pushed until we stop.
+	config.Metrics.FinalPushTimeout = cli.Duration(10 * time.Second)
+	config.Metrics.MaxStopWait = cli.Duration(50 * time.Millisecond)
+	m := initMetrics(config)
+	m.backends = []backend{slowBackend{}}
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	start := time.Now()
+	assert.Error(t, m.stop())
+	assert.True(t, time.Since(start) < time.Second, "Stop should have given up on the final push")
+}
+
+func TestMaxStopWaitInFlight(t *testing.T) {
+	config := makeConfig(time.Hour, timeout, nil, false)
+	config.Metrics.PushTimeout = cli.Duration(10 * time.Second)
+	config.Metrics.MaxStopWait = cli.Duration(50 * time.Millisecond)
+	m := initMetrics(config)
+	m.backends = []backend{slowBackend{}}
+	m.heartbeat()
+	time.Sleep(10 * time.Millisecond) // Give it time to start pushing.
+	start := time.Now()
+	assert.Error(t, m.stop())
+	assert.True(t, time.Since(start) < time.Second, "Stop shouldn't wait for the push in progress")
+}
+
+func TestFinalPushWithoutTimeout(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.FinalPushTimeout = 0
+	m := initMetricsWithClock(config, newFakeClock()) // Its After never fires, so the push can't time out.
+	b := &recordingBackend{}
+	m.backends = []backend{b}
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	assert.NoError(t, m.stop())
+	assert.Equal(t, 1, b.pushes, "Should still push at the end without metrics.maxstopwait")
+}
+
+func TestTimeToFirstTarget(t *testing.T) {
+	clock := newFakeClock()
+	m := initMetricsWithClock(makeConfig(verySlow, timeout, nil, false), clock)
+	clock.Advance(3 * time.Second)
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	clock.Advance(3 * time.Second)
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	metric := &dto.Metric{}
+	assert.NoError(t, m.firstTargetGauge.Write(metric))
+	assert.Equal(t, 3.0, metric.GetGauge().GetValue())
+}
+
+func TestCacheable(t *testing.T) {
+	m := initMetrics(makeConfig(verySlow, timeout, nil, false))
+	target := core.NewBuildTarget(label)
+	target.SetState(core.Built)
+	m.record(context.Background(), target, time.Millisecond)
+	target.SetState(core.Reused)
+	m.record(context.Background(), target, time.Millisecond)
+	filegroup := core.NewBuildTarget(core.ParseBuildLabel("//src/metrics:filegroup", ""))
+	filegroup.IsFilegroup = true
+	filegroup.SetState(core.Built)
+	m.record(context.Background(), filegroup, time.Millisecond)
+	metric := &dto.Metric{}
+	m.cacheCounter.WithLabelValues("false", "true").Write(metric)
+	assert.Equal(t, 1.0, metric.Counter.GetValue())
+	m.cacheCounter.WithLabelValues("false", "false").Write(metric)
+	assert.Equal(t, 2.0, metric.Counter.GetValue())
+}
+
+func TestSummarise(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Metrics.LogSummary = true
+	m := initMetrics(config)
+	assert.Equal(t, 0, len(m.backends))
+	summary, err := summarise(m.registry, m.constLabels)
+	assert.NoError(t, err)
+	assert.Equal(t, "nothing recorded", summary)
+	target := core.NewBuildTarget(label)
+	target.SetState(core.Built)
+	m.record(context.Background(), target, 2*time.Second)
+	m.record(context.Background(), target, time.Second)
+	summary, err = summarise(m.registry, m.constLabels)
+	assert.NoError(t, err)
+	assert.Contains(t, summary, "cache_hits{cacheable=true,hit=false}=2")
+	assert.Contains(t, summary, "build_durations_histogram{execution=local,sandboxed=false}:count=2")
+	assert.Contains(t, summary, "build_durations_histogram{execution=local,sandboxed=false}:sum=3")
+	assert.NotContains(t, summary, "hit=true")
+	assert.NotContains(t, summary, "user=")
+	assert.NoError(t, m.stop())
+}
+
+func TestTargetKind(t *testing.T) {
+	target := core.NewBuildTarget(label)
+	assert.Equal(t, "alias", targetKind(target))
+	target.AddOutput("out.txt")
+	assert.Equal(t, "rule", targetKind(target))
+	target.IsFilegroup = true
+	assert.Equal(t, "filegroup", targetKind(target))
+	target.IsHashFilegroup = true
+	assert.Equal(t, "hash_filegroup", targetKind(target))
+	target.IsRemoteFile = true
+	assert.Equal(t, "remote_file", targetKind(target))
+	target.IsTest = true
+	assert.Equal(t, "test", targetKind(target))
+}
+
+func TestScopedLabels(t *testing.T) {
+	config := makeConfig(verySlow, timeout, nil, false)
+	config.Metrics.ScopedLabels = []string{"phase"}
+	m := initMetrics(config)
+	target := core.NewBuildTarget(label)
+	target.SetState(core.Built)
+	ctx := WithLabels(context.Background(), map[string]string{"phase": "migrating", "ignored": "yes"})
+	m.record(ctx, target, time.Millisecond)
+	m.record(context.Background(), target, time.Millisecond)
+	ch := make(chan prometheus.Metric, 2)
+	m.cacheCounter.Collect(ch)
+	close(ch)
+	phases := []string{}
+	for metric := range ch {
+		pb := &dto.Metric{}
+		assert.NoError(t, metric.Write(pb))
+		for _, label := range pb.Label {
+			assert.NotEqual(t, "ignored", label.GetName())
+			if label.GetName() == "phase" {
+				phases = append(phases, label.GetValue())
+			}
+		}
+	}
+	sort.Strings(phases)
+	assert.Equal(t, []string{"", "migrating"}, phases)
+}
+
+func TestWithLabelsNested(t *testing.T) {
+	ctx := WithLabels(context.Background(), map[string]string{"a": "1", "b": "2"})
+	ctx2 := WithLabels(ctx, map[string]string{"b": "3"})
+	assert.Equal(t, map[string]string{"a": "1", "b": "3"}, labelsFromContext(ctx2))
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, labelsFromContext(ctx))
+}
+
+func TestMemCache(t *testing.T) {
+	m := initMetricsWithClock(makeConfig(verySlow, timeout, nil, false), newFakeClock())
+	var hits, misses int64 = 3, 1
+	m.memCache = func() (int64, int64) { return hits, misses }
+	m.sampleMemCache()
+	assert.True(t, m.hasNew())
+	m.newMetrics = 0
+	m.sampleMemCache()
+	assert.False(t, m.hasNew(), "Should not need to push again when nothing has changed")
+	hits = 5
+	m.sampleMemCache()
+	metric := &dto.Metric{}
+	assert.NoError(t, m.memCacheHitCounter.Write(metric))
+	assert.Equal(t, 5.0, metric.GetCounter().GetValue())
+	assert.NoError(t, m.memCacheMissCounter.Write(metric))
+	assert.Equal(t, 1.0, metric.GetCounter().GetValue())
+}
+
+func TestOutputPlacement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_placement_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	src := path.Join(dir, "src")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("hello"), 0644))
+	m := initMetricsWithClock(makeConfig(verySlow, timeout, nil, false), newFakeClock())
+	m.lastPlacements[0], m.lastPlacements[1], m.lastPlacements[2] = fs.PlacementStats()
+	assert.NoError(t, fs.CopyOrLinkFile(src, path.Join(dir, "linked"), 0644, true, false))
+	assert.NoError(t, fs.CopyOrLinkFile(src, path.Join(dir, "copied"), 0644, false, false))
+	m.samplePlacements()
+	assert.True(t, m.hasNew())
+	metric := &dto.Metric{}
+	assert.NoError(t, m.placementCounter.WithLabelValues("copy").Write(metric))
+	assert.Equal(t, 1.0, metric.GetCounter().GetValue())
+	assert.NoError(t, m.placementCounter.WithLabelValues("hardlink").Write(metric))
+	assert.Equal(t, 1.0, metric.GetCounter().GetValue())
+}
+
+func TestPrivateRegistry(t *testing.T) {
+	m := initMetrics(makeConfig(verySlow, timeout, nil, false))
+	m.record(context.Background(), core.NewBuildTarget(label), time.Millisecond)
+	names := func(g prometheus.Gatherer) []string {
+		families, err := g.Gather()
+		assert.NoError(t, err)
+		ret := []string{}
+		for _, family := range families {
+			ret = append(ret, family.GetName())
+		}
+		return ret
+	}
+	assert.Contains(t, names(m.registry), "build_counts")
+	assert.NotContains(t, names(prometheus.DefaultGatherer), "build_counts")
+}
+
 func TestExportedFunctions(t *testing.T) {
 	// For various reasons it's important that this is the only test that uses the global singleton.
 	config := core.DefaultConfiguration()
 	config.Metrics.PushGatewayURL = url
 	config.Metrics.PushFrequency = verySlow
-	InitFromConfig(config)
+	InitFromConfig(config, 2)
 	Record(core.NewBuildTarget(label), time.Millisecond)
+	RecordCancelled(core.NewBuildTarget(label))
+	RecordPlatformSkip("plan9", "mips")
 	Stop()
-	assert.Equal(t, 1, m.errors)
+	// The heartbeat at init may or may not have been pushed separately before we stopped.
+	assert.True(t, m.errors == 1 || m.errors == 2, "Expected the pushes to fail, got %d errors", m.errors)
+	metric := &dto.Metric{}
+	assert.NoError(t, m.goalsGauge.Write(metric))
+	assert.Equal(t, 2.0, metric.GetGauge().GetValue())
+	assert.NoError(t, m.startedCounter.Write(metric))
+	assert.Equal(t, 1.0, metric.GetCounter().GetValue())
+	assert.NoError(t, m.cancelledCounter.Write(metric))
+	assert.Equal(t, 1.0, metric.GetCounter().GetValue())
+	assert.NoError(t, m.platformSkipCounter.WithLabelValues("plan9", "mips").Write(metric))
+	assert.Equal(t, 1.0, metric.GetCounter().GetValue())
+}
+
+// A recordingBackend is a backend that records the names of the metrics pushed to it.
+type recordingBackend struct {
+	names  []string
+	pushes int
+}
+
+func (b *recordingBackend) Push(gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	b.names = nil
+	for _, family := range families {
+		b.names = append(b.names, family.GetName())
+	}
+	b.pushes++
+	return err
+}
+
+// A slowBackend is a backend that takes a long time to push anything.
+type slowBackend struct{}
+
+func (b slowBackend) Push(gatherer prometheus.Gatherer) error {
+	time.Sleep(5 * time.Second)
+	return nil
+}
+
+// A fakeClock is an implementation of clock whose time only moves when told to.
+// Its tickers never tick; tests call tick() directly instead.
+type fakeClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker       { return fakeTicker{} }
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return nil }
+
+type fakeTicker struct{}
+
+func (fakeTicker) C() <-chan time.Time { return nil }
+func (fakeTicker) Stop()               {}
+
+// makeConfig returns a config with the given metrics settings.
+func makeConfig(frequency, timeout time.Duration, customLabels map[string]string, perTest bool) *core.Configuration {
+	config := core.DefaultConfiguration()
+	config.Metrics.PushGatewayURL = url
+	config.Metrics.PushFrequency = cli.Duration(frequency)
+	config.Metrics.PushTimeout = cli.Duration(timeout)
+	config.Metrics.PerTest = perTest
+	config.CustomMetricLabels = customLabels
+	return config
 }
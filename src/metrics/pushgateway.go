@@ -0,0 +1,149 @@
+// +build !bootstrap
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
+
+	"core"
+)
+
+// A pushGateway is a backend that pushes to a Prometheus pushgateway.
+// This is much the same as what the push package does, but lets us choose the HTTP client.
+type pushGateway struct {
+	url       string
+	format    expfmt.Format
+	pathStyle func(url string) string
+	client    *http.Client
+}
+
+// pushFormats maps the allowed values of Metrics.PushFormat to the formats they represent.
+// The default is the same as the push package's, which the pushgateway prefers.
+var pushFormats = map[string]expfmt.Format{
+	"":         expfmt.FmtProtoDelim,
+	"protobuf": expfmt.FmtProtoDelim,
+	"text":     expfmt.FmtText,
+}
+
+// pushPathStyles maps the allowed values of Metrics.PushPathStyle to functions that return the URL
+// to push our group to, given the configured base URL.
+var pushPathStyles = map[string]func(url string) string{
+	"":         defaultGroupURL,
+	"default":  defaultGroupURL,
+	"legacy":   legacyGroupURL,
+	"verbatim": func(url string) string { return url },
+}
+
+func newPushGateway(config *core.Configuration) *pushGateway {
+	format, present := pushFormats[config.Metrics.PushFormat]
+	if !present {
+		panic(fmt.Sprintf("Invalid metrics push format %s, must be protobuf or text", config.Metrics.PushFormat))
+	}
+	pathStyle, present := pushPathStyles[config.Metrics.PushPathStyle]
+	if !present {
+		panic(fmt.Sprintf("Invalid metrics push path style %s, must be default, legacy or verbatim", config.Metrics.PushPathStyle))
+	}
+	url := config.Metrics.PushGatewayURL.String()
+	if config.Metrics.PushPathStyle != "verbatim" {
+		url = strings.TrimSuffix(url, "/")
+	}
+	return &pushGateway{
+		url:       url,
+		format:    format,
+		pathStyle: pathStyle,
+		client:    newHTTPClient(config),
+	}
+}
+
+func (p *pushGateway) Push(gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, p.format)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, p.groupURL(), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(p.format))
+	return p.do(req, "push")
+}
+
+// Delete deletes all metrics in our group from the pushgateway.
+func (p *pushGateway) Delete() error {
+	req, err := http.NewRequest(http.MethodDelete, p.groupURL(), nil)
+	if err != nil {
+		return err
+	}
+	return p.do(req, "delete")
+}
+
+// groupURL returns the URL for our grouping key on the pushgateway.
+func (p *pushGateway) groupURL() string {
+	return p.pathStyle(p.url)
+}
+
+// defaultGroupURL returns the group URL in the layout used by current versions of the pushgateway,
+// which is /metrics/job/<job>/<label>/<value>.
+func defaultGroupURL(url string) string {
+	groupURL := url + "/metrics/job/please"
+	for k, v := range push.HostnameGroupingKey() {
+		groupURL += "/" + k + "/" + neturl.PathEscape(v)
+	}
+	return groupURL
+}
+
+// legacyGroupURL returns the group URL in the layout used by older versions of the pushgateway,
+// which is /metrics/jobs/<job>/instances/<instance>.
+func legacyGroupURL(url string) string {
+	groupURL := url + "/metrics/jobs/please"
+	for k, v := range push.HostnameGroupingKey() {
+		groupURL += "/" + k + "s/" + neturl.PathEscape(v)
+	}
+	return groupURL
+}
+
+// do sends the given request to the pushgateway and checks the response.
+func (p *pushGateway) do(req *http.Request, op string) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Pushgateway %s failed: %s %s", op, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// newHTTPClient returns the HTTP client that the push backends use.
+// This goes via metrics.proxyurl if it's set, or otherwise honours the standard proxy
+// environment variables (HTTP_PROXY, HTTPS_PROXY and NO_PROXY).
+func newHTTPClient(config *core.Configuration) *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if config.Metrics.ProxyURL != "" {
+		u, err := neturl.Parse(config.Metrics.ProxyURL.String())
+		if err != nil {
+			panic(fmt.Sprintf("Invalid metrics proxy URL %s: %s", config.Metrics.ProxyURL, err))
+		}
+		proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: &http.Transport{Proxy: proxy}}
+}
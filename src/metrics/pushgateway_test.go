@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"cli"
+	"core"
+)
+
+func TestPushGateway(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	config := core.DefaultConfiguration()
+	config.Metrics.PushGatewayURL = cli.URL(server.URL + "/")
+	assert.NoError(t, newPushGateway(config).Push(prometheus.NewRegistry()))
+	assert.True(t, strings.HasPrefix(path, "/metrics/job/please/instance/"), path)
+}
+
+func TestPushGatewayPathStyles(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	config := core.DefaultConfiguration()
+	config.Metrics.PushGatewayURL = cli.URL(server.URL + "/")
+	config.Metrics.PushPathStyle = "legacy"
+	assert.NoError(t, newPushGateway(config).Push(prometheus.NewRegistry()))
+	assert.True(t, strings.HasPrefix(path, "/metrics/jobs/please/instances/"), path)
+	config.Metrics.PushGatewayURL = cli.URL(server.URL + "/custom/push/path")
+	config.Metrics.PushPathStyle = "verbatim"
+	assert.NoError(t, newPushGateway(config).Push(prometheus.NewRegistry()))
+	assert.Equal(t, "/custom/push/path", path)
+	config.Metrics.PushPathStyle = "v2"
+	assert.Panics(t, func() { newPushGateway(config) })
+}
+
+func TestPushGatewayDelete(t *testing.T) {
+	var method, path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	config := core.DefaultConfiguration()
+	config.Metrics.PushGatewayURL = cli.URL(server.URL)
+	assert.NoError(t, newPushGateway(config).Delete())
+	assert.Equal(t, http.MethodDelete, method)
+	assert.True(t, strings.HasPrefix(path, "/metrics/job/please/instance/"), path)
+}
+
+func TestClearOnStart(t *testing.T) {
+	deletes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deletes++
+		}
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	config := core.DefaultConfiguration()
+	config.Metrics.PushGatewayURL = cli.URL(server.URL)
+	config.Metrics.ClearOnStart = true
+	m := initMetrics(config)
+	assert.Equal(t, 1, deletes)
+	assert.Equal(t, 0, m.errors, "Failing to clear shouldn't count towards the push errors")
+	m.stop()
+}
+
+func TestHeartbeat(t *testing.T) {
+	pushed := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		pushed <- string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	config := core.DefaultConfiguration()
+	config.Metrics.PushGatewayURL = cli.URL(server.URL)
+	config.Metrics.PushFormat = "text"
+	config.Metrics.PushFrequency = cli.Duration(time.Hour)
+	m := initMetrics(config)
+	m.heartbeat()
+	select {
+	case body := <-pushed:
+		assert.Contains(t, body, "build_started_total")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Heartbeat wasn't pushed")
+	}
+	m.stop()
+}
+
+func TestPushGatewayTextFormat(t *testing.T) {
+	var contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	config := core.DefaultConfiguration()
+	config.Metrics.PushGatewayURL = cli.URL(server.URL)
+	config.Metrics.PushFormat = "text"
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_counter", Help: "A counter"})
+	registry.MustRegister(counter)
+	assert.NoError(t, newPushGateway(config).Push(registry))
+	assert.True(t, strings.HasPrefix(contentType, "text/plain"), contentType)
+	assert.Contains(t, body, "test_counter 0")
+}
+
+func TestPushGatewayInvalidFormat(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Metrics.PushGatewayURL = "http://localhost:9091"
+	config.Metrics.PushFormat = "json"
+	assert.Panics(t, func() { newPushGateway(config) })
+}
+
+func TestPushGatewayError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	config := core.DefaultConfiguration()
+	config.Metrics.PushGatewayURL = cli.URL(server.URL)
+	assert.Error(t, newPushGateway(config).Push(prometheus.NewRegistry()))
+}
+
+func TestPushViaProxy(t *testing.T) {
+	var host string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer proxy.Close()
+	config := core.DefaultConfiguration()
+	config.Metrics.PushGatewayURL = "http://pushgateway.example.com:9091"
+	config.Metrics.RemoteWriteURL = "http://remotewrite.example.com/api/v1/push"
+	config.Metrics.ProxyURL = cli.URL(proxy.URL)
+	assert.NoError(t, newPushGateway(config).Push(prometheus.NewRegistry()))
+	assert.Equal(t, "pushgateway.example.com:9091", host)
+	assert.NoError(t, newRemoteWrite(config).Push(prometheus.NewRegistry()))
+	assert.Equal(t, "remotewrite.example.com", host)
+}
@@ -0,0 +1,158 @@
+// +build !bootstrap
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+
+	"core"
+	pb "metrics/proto/remote_write"
+)
+
+// A remoteWrite is a backend that sends metrics to a Prometheus remote write endpoint.
+type remoteWrite struct {
+	url, username, password string
+	client                  *http.Client
+}
+
+func newRemoteWrite(config *core.Configuration) *remoteWrite {
+	return &remoteWrite{
+		url:      config.Metrics.RemoteWriteURL.String(),
+		username: config.Metrics.RemoteWriteUsername,
+		password: config.Metrics.RemoteWritePassword,
+		client:   newHTTPClient(config),
+	}
+}
+
+func (r *remoteWrite) Push(gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	b, err := proto.Marshal(toWriteRequest(families, time.Now()))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(snappy.Encode(nil, b)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Remote write failed: %s %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// toWriteRequest converts a set of gathered metrics to a remote write request.
+// The job & instance labels are added to match what the pushgateway would apply.
+func toWriteRequest(families []*dto.MetricFamily, now time.Time) *pb.WriteRequest {
+	extraLabels := groupingLabels()
+	defaultTimestamp := now.UnixNano() / int64(time.Millisecond)
+	req := &pb.WriteRequest{}
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.Metric {
+			timestamp := defaultTimestamp
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+			add := func(name string, value float64, labels ...string) {
+				req.Timeseries = append(req.Timeseries, &pb.TimeSeries{
+					Labels:  toLabels(name, metric.Label, extraLabels, labels...),
+					Samples: []*pb.Sample{{Value: value, Timestamp: timestamp}},
+				})
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, q := range summary.Quantile {
+					add(name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", summary.GetSampleSum())
+				add(name+"_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.Bucket {
+					add(name+"_bucket", float64(bucket.GetCumulativeCount()), "le", formatFloat(bucket.GetUpperBound()))
+				}
+				if n := len(histogram.Bucket); n == 0 || !math.IsInf(histogram.Bucket[n-1].GetUpperBound(), 1) {
+					add(name+"_bucket", float64(histogram.GetSampleCount()), "le", "+Inf")
+				}
+				add(name+"_sum", histogram.GetSampleSum())
+				add(name+"_count", float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+	return req
+}
+
+// groupingLabels returns the labels that the pushgateway applies to everything we push to it.
+// Other backends add them too, so metrics look the same wherever they end up.
+func groupingLabels() map[string]string {
+	labels := map[string]string{"job": "please"}
+	for k, v := range push.HostnameGroupingKey() {
+		labels[k] = v
+	}
+	return labels
+}
+
+// toLabels converts a metric's labels to remote write labels, sorted by name as the protocol requires.
+// extra is a list of alternating label names and values.
+func toLabels(name string, labels []*dto.LabelPair, extraLabels map[string]string, extra ...string) []*pb.Label {
+	ret := []*pb.Label{{Name: "__name__", Value: name}}
+	seen := map[string]bool{}
+	for _, label := range labels {
+		ret = append(ret, &pb.Label{Name: label.GetName(), Value: label.GetValue()})
+		seen[label.GetName()] = true
+	}
+	for i := 0; i < len(extra); i += 2 {
+		ret = append(ret, &pb.Label{Name: extra[i], Value: extra[i+1]})
+	}
+	for k, v := range extraLabels {
+		if !seen[k] {
+			ret = append(ret, &pb.Label{Name: k, Value: v})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// formatFloat formats a float in the same way Prometheus does for bucket bounds & quantiles.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"cli"
+	"core"
+	pb "metrics/proto/remote_write"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	var req pb.WriteRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "tenant", user)
+		assert.Equal(t, "secret", pass)
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		b, _ := ioutil.ReadAll(r.Body)
+		b, err := snappy.Decode(nil, b)
+		assert.NoError(t, err)
+		assert.NoError(t, proto.Unmarshal(b, &req))
+	}))
+	defer server.Close()
+
+	config := core.DefaultConfiguration()
+	config.Metrics.RemoteWriteURL = cli.URL(server.URL)
+	config.Metrics.RemoteWriteUsername = "tenant"
+	config.Metrics.RemoteWritePassword = "secret"
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_counter", Help: "A counter"}, []string{"zzz"})
+	registry.MustRegister(counter)
+	counter.WithLabelValues("hello").Inc()
+
+	assert.NoError(t, newRemoteWrite(config).Push(registry))
+	assert.Equal(t, 1, len(req.Timeseries))
+	ts := req.Timeseries[0]
+	assert.Equal(t, 1.0, ts.Samples[0].Value)
+	names := []string{}
+	for _, label := range ts.Labels {
+		names = append(names, label.Name)
+	}
+	assert.Equal(t, []string{"__name__", "instance", "job", "zzz"}, names)
+}
+
+func TestRemoteWriteHistogram(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "test_histogram",
+		Help:    "A histogram",
+		Buckets: []float64{0.5, 1},
+	})
+	registry.MustRegister(histogram)
+	histogram.Observe(0.7)
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	req := toWriteRequest(families, time.Unix(1000, 0))
+	// Two buckets, +Inf, sum & count.
+	assert.Equal(t, 5, len(req.Timeseries))
+	assert.EqualValues(t, 1000000, req.Timeseries[0].Samples[0].Timestamp)
+	assert.Equal(t, "+Inf", req.Timeseries[2].Labels[3].Value)
+	assert.Equal(t, "test_histogram_count", req.Timeseries[4].Labels[0].Value)
+}
+
+func TestRemoteWriteError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	config := core.DefaultConfiguration()
+	config.Metrics.RemoteWriteURL = cli.URL(server.URL)
+	assert.Error(t, newRemoteWrite(config).Push(prometheus.NewRegistry()))
+}
@@ -4,14 +4,111 @@
 
 package metrics
 
+import "context"
 import "core"
 import "time"
 
 // InitFromConfig does nothing in this file, it's just a stub.
-func InitFromConfig(config *core.Configuration) {}
+func InitFromConfig(config *core.Configuration, goals int) {}
+
+// RecordStart does nothing in this file, it's just a stub.
+func RecordStart(target *core.BuildTarget, test bool) {}
 
 // Record does nothing in this file, it's just a stub.
 func Record(target *core.BuildTarget, d time.Duration) {}
 
+// RecordContext does nothing in this file, it's just a stub.
+func RecordContext(ctx context.Context, target *core.BuildTarget, d time.Duration) {}
+
+// RecordCPU does nothing in this file, it's just a stub.
+func RecordCPU(target *core.BuildTarget, cpuSeconds float64) {}
+
+// RecordCacheEntries does nothing in this file, it's just a stub.
+func RecordCacheEntries(target *core.BuildTarget, count int) {}
+
+// RecordCacheMiss does nothing in this file, it's just a stub.
+func RecordCacheMiss(target *core.BuildTarget, key []byte) {}
+
+// RecordDedup does nothing in this file, it's just a stub.
+func RecordDedup() {}
+
+// RecordRemoteFetch does nothing in this file, it's just a stub.
+func RecordRemoteFetch(kind string) {}
+
+// SetGraphDepth does nothing in this file, it's just a stub.
+func SetGraphDepth(n int) {}
+
+// RecordUnusedTargets does nothing in this file, it's just a stub.
+func RecordUnusedTargets(graph *core.BuildGraph, goals core.BuildLabels) {}
+
+// RecordTargetKind does nothing in this file, it's just a stub.
+func RecordTargetKind(target *core.BuildTarget) {}
+
+// RecordPlatformSkip does nothing in this file, it's just a stub.
+func RecordPlatformSkip(os, arch string) {}
+
+// RecordCacheKey does nothing in this file, it's just a stub.
+func RecordCacheKey(target *core.BuildTarget, key []byte) {}
+
+// RecordCompression does nothing in this file, it's just a stub.
+func RecordCompression(ratio float64) {}
+
+// SampleMemCache does nothing in this file, it's just a stub.
+func SampleMemCache(f func() (hits, misses int64)) {}
+
+// RecordParseError does nothing in this file, it's just a stub.
+func RecordParseError(kind string) {}
+
+// RecordIO does nothing in this file, it's just a stub.
+func RecordIO(target *core.BuildTarget, read, write int64) {}
+
+// RecordWorkerFailure does nothing in this file, it's just a stub.
+func RecordWorkerFailure(worker string) {}
+
+// RecordHashMismatch does nothing in this file, it's just a stub.
+func RecordHashMismatch(target *core.BuildTarget) {}
+
+// RecordCancelled does nothing in this file, it's just a stub.
+func RecordCancelled(target *core.BuildTarget) {}
+
+// RecordRun does nothing in this file, it's just a stub.
+func RecordRun(duration time.Duration) {}
+
+// RecordFDs does nothing in this file, it's just a stub.
+func RecordFDs(target *core.BuildTarget, count int) {}
+
+// RecordCacheAuth does nothing in this file, it's just a stub.
+func RecordCacheAuth(duration time.Duration) {}
+
+// RecordCacheGC does nothing in this file, it's just a stub.
+func RecordCacheGC(size uint64) {}
+
+// RecordCacheFallback does nothing in this file, it's just a stub.
+func RecordCacheFallback(from, to string) {}
+
+// RecordCacheBytes does nothing in this file, it's just a stub.
+func RecordCacheBytes(tier, direction string, n int) {}
+
+// RecordTestConcurrency does nothing in this file, it's just a stub.
+func RecordTestConcurrency(requested, effective int) {}
+
+// RecordCacheEnabled does nothing in this file, it's just a stub.
+func RecordCacheEnabled(enabled bool) {}
+
+// SetLabels does nothing in this file, it's just a stub.
+func SetLabels(labels map[string]string) {}
+
+// RecordStartup does nothing in this file, it's just a stub.
+func RecordStartup(duration time.Duration) {}
+
+// SetAffectedTargets does nothing in this file, it's just a stub.
+func SetAffectedTargets(n int) {}
+
+// SampleQueueDepth does nothing in this file, it's just a stub.
+func SampleQueueDepth(f func() int) {}
+
 // Stop does nothing in this file, it's just a stub.
 func Stop() {}
+
+// StopE does nothing in this file, it's just a stub.
+func StopE() error { return nil }
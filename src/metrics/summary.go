@@ -0,0 +1,59 @@
+// +build !bootstrap
+
+package metrics
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// summarise gathers metrics and formats them into a single readable line.
+// Histograms & summaries are reported as their count and sum. The given const labels are omitted
+// since they're the same on everything, as are empty labels and anything that's zero.
+func summarise(gatherer prometheus.Gatherer, constLabels prometheus.Labels) (string, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return "", err
+	}
+	parts := []string{}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			labels := []string{}
+			for _, label := range metric.Label {
+				if _, present := constLabels[label.GetName()]; !present && label.GetValue() != "" {
+					labels = append(labels, label.GetName()+"="+label.GetValue())
+				}
+			}
+			name := family.GetName()
+			if len(labels) > 0 {
+				name += "{" + strings.Join(labels, ",") + "}"
+			}
+			add := func(suffix string, value float64) {
+				if value != 0 {
+					parts = append(parts, fmt.Sprintf("%s%s=%s", name, suffix, formatFloat(value)))
+				}
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				add(":count", float64(metric.GetHistogram().GetSampleCount()))
+				add(":sum", metric.GetHistogram().GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				add(":count", float64(metric.GetSummary().GetSampleCount()))
+				add(":sum", metric.GetSummary().GetSampleSum())
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return "nothing recorded", nil
+	}
+	return strings.Join(parts, " "), nil
+}
@@ -21,6 +21,7 @@ import (
 	"build"
 	"cli"
 	"core"
+	"metrics"
 	"test"
 )
 
@@ -173,6 +174,22 @@ func yesNo(b bool) string {
 	return "no"
 }
 
+// recordCancelled records metrics for any targets that are still building on other threads
+// when we're about to stop because of a failure, since their builds won't be completed.
+func recordCancelled(buildingTargets []buildingTarget, failedThread int) {
+	for i := range buildingTargets {
+		if i == failedThread {
+			continue
+		}
+		buildingTargets[i].Lock()
+		target := buildingTargets[i].Target
+		buildingTargets[i].Unlock()
+		if target != nil && target.State() == core.Building {
+			metrics.RecordCancelled(target)
+		}
+	}
+}
+
 func processResult(state *core.BuildState, result *core.BuildResult, buildingTargets []buildingTarget, aggregatedResults *core.TestResults, plainOutput bool,
 	keepGoing bool, failedTargets, failedNonTests *[]core.BuildLabel, failedTargetMap map[core.BuildLabel]error, shouldTrace bool) {
 	label := result.Label
@@ -203,6 +220,9 @@ func processResult(state *core.BuildState, result *core.BuildResult, buildingTar
 		if !keepGoing && result.Status != core.TargetTestFailed {
 			// Reset colour so the entire compiler error output doesn't appear red.
 			log.Errorf("%s failed:${RESET}\n%s", result.Label, shortError(result.Err))
+			if len(*failedNonTests) == 0 {
+				recordCancelled(buildingTargets, result.ThreadID)
+			}
 			state.KillAll()
 		} else if !plainOutput { // plain output will have already logged this
 			log.Errorf("%s failed: %s", result.Label, shortError(result.Err))
@@ -14,6 +14,7 @@ import (
 	"gopkg.in/op/go-logging.v1"
 
 	"core"
+	"metrics"
 )
 
 var log = logging.MustGetLogger("asp")
@@ -79,10 +80,12 @@ func (p *Parser) MustLoadBuiltins(filename string, contents, encoded []byte) {
 func (p *Parser) ParseFile(pkg *core.Package, filename string) error {
 	statements, err := p.parse(filename)
 	if err != nil {
+		metrics.RecordParseError("syntax")
 		return err
 	}
 	_, err = p.interpreter.interpretAll(pkg, statements)
 	if err != nil {
+		metrics.RecordParseError("type_error")
 		f, _ := os.Open(filename)
 		p.annotate(err, f)
 	}
@@ -9,11 +9,13 @@ package parse
 import (
 	"fmt"
 	"path"
+	"runtime"
 
 	"gopkg.in/op/go-logging.v1"
 
 	"core"
 	"fs"
+	"metrics"
 )
 
 var log = logging.MustGetLogger("parse")
@@ -77,6 +79,7 @@ func activateTarget(state *core.BuildState, pkg *core.Package, label, dependor c
 	if !label.IsAllTargets() && state.Graph.Target(label) == nil {
 		msg := fmt.Sprintf("Parsed build file %s but it doesn't contain target %s", pkg.Filename, label.Name)
 		if dependor != core.OriginalTarget {
+			metrics.RecordParseError("missing_dep")
 			msg += fmt.Sprintf(" (depended on by %s)", dependor)
 		}
 		return fmt.Errorf(msg + suggestTargets(pkg, label, dependor))
@@ -93,6 +96,8 @@ func activateTarget(state *core.BuildState, pkg *core.Package, label, dependor c
 				if !state.NeedTests || target.IsTest || state.NeedCoverage {
 					addDep(state, target.Label, dependor, false, dependor.IsAllTargets())
 				}
+			} else if platformSkipped(target) {
+				metrics.RecordPlatformSkip(runtime.GOOS, runtime.GOARCH)
 			}
 		}
 	} else {
@@ -104,6 +109,12 @@ func activateTarget(state *core.BuildState, pkg *core.Package, label, dependor c
 	return nil
 }
 
+// platformSkipped returns true if the given target is left out of wildcards only because it's
+// marked as manual on the platform we're running on.
+func platformSkipped(target *core.BuildTarget) bool {
+	return target.HasLabel("manual:"+core.OsArch) && !target.HasLabel("manual")
+}
+
 // parsePackage performs the initial parse of a package.
 func parsePackage(state *core.BuildState, label, dependor core.BuildLabel, subrepo *core.Subrepo) (*core.Package, error) {
 	packageName := label.PackageName
@@ -118,6 +129,9 @@ func parsePackage(state *core.BuildState, label, dependor core.BuildLabel, subre
 			return nil, errTryAgain
 		}
 		exists := core.PathExists(packageName)
+		if dependor != core.OriginalTarget {
+			metrics.RecordParseError("missing_dep")
+		}
 		// Handle quite a few cases to provide more obvious error messages.
 		if dependor != core.OriginalTarget && exists {
 			return nil, fmt.Errorf("%s depends on %s, but there's no BUILD file in %s/", dependor, label, packageName)
@@ -135,6 +149,7 @@ func parsePackage(state *core.BuildState, label, dependor core.BuildLabel, subre
 	allTargets := pkg.AllTargets()
 	for _, target := range allTargets {
 		state.Graph.AddTarget(target)
+		metrics.RecordTargetKind(target)
 		if target.IsFilegroup {
 			// At least register these guys as outputs.
 			// It's difficult to handle non-file sources because we don't know if they're
@@ -202,6 +217,7 @@ func addDep(state *core.BuildState, label, dependor core.BuildLabel, rescan, for
 	}
 	if target.State() >= core.Active && !rescan {
 		if !forceBuild {
+			metrics.RecordDedup()
 			return // Target is already tagged to be built and likely on the queue.
 		}
 		log.Debug("Forcing build of %s", label)
@@ -109,6 +109,18 @@ func TestAddParseDepDeferred(t *testing.T) {
 	assert.Equal(t, 2, state.NumActive())
 }
 
+func TestPlatformSkipped(t *testing.T) {
+	target := makeTarget("//package1:target1")
+	assert.False(t, platformSkipped(target))
+	target.AddLabel("manual:" + core.OsArch)
+	assert.True(t, platformSkipped(target))
+	target.AddLabel("manual")
+	assert.False(t, platformSkipped(target), "It'd be skipped on any platform")
+	target = makeTarget("//package1:target2")
+	target.AddLabel("manual:plan9_mips")
+	assert.False(t, platformSkipped(target))
+}
+
 func makeTarget(label string, deps ...string) *core.BuildTarget {
 	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
 	for _, dep := range deps {
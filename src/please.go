@@ -43,6 +43,9 @@ var log = logging.MustGetLogger("plz")
 
 var config *core.Configuration
 
+// startTime is the time the process started, give or take.
+var startTime = time.Now()
+
 var opts struct {
 	Usage      string `usage:"Please is a high-performance multi-language build system.\n\nIt uses BUILD files to describe what to build and how to build it.\nSee https://please.build for more information about how it works and what Please can do for you."`
 	BuildFlags struct {
@@ -55,6 +58,7 @@ var opts struct {
 		Exclude    []string        `short:"e" long:"exclude" description:"Label of targets to exclude from automatic detection."`
 		Option     ConfigOverrides `short:"o" long:"override" env:"PLZ_OVERRIDES" env-delim:";" description:"Options to override from .plzconfig (e.g. -o please.selfupdate:false)"`
 		Profile    string          `long:"profile" env:"PLZ_CONFIG_PROFILE" description:"Configuration profile to load; e.g. --profile=dev will load .plzconfig.dev if it exists."`
+		MetricsTag []string        `long:"metrics_tag" description:"Additional label to apply to all metrics, as key=value. Can be repeated."`
 	} `group:"Options controlling what to build & how to build it"`
 
 	OutputFlags struct {
@@ -377,19 +381,19 @@ var buildFunctions = map[string]func() bool{
 		return success || opts.Cover.FailingTestsOk
 	},
 	"run": func() bool {
-		if success, state := runBuild([]core.BuildLabel{opts.Run.Args.Target}, true, false); success {
+		if success, state := runBuildForRun([]core.BuildLabel{opts.Run.Args.Target}); success {
 			run.Run(state, opts.Run.Args.Target, opts.Run.Args.Args, opts.Run.Env)
 		}
 		return false // We should never return from run.Run so if we make it here something's wrong.
 	},
 	"parallel": func() bool {
-		if success, state := runBuild(opts.Run.Parallel.PositionalArgs.Targets, true, false); success {
+		if success, state := runBuildForRun(opts.Run.Parallel.PositionalArgs.Targets); success {
 			os.Exit(run.Parallel(state, state.ExpandOriginalTargets(), opts.Run.Parallel.Args, opts.Run.Parallel.NumTasks, opts.Run.Parallel.Quiet, opts.Run.Env))
 		}
 		return false
 	},
 	"sequential": func() bool {
-		if success, state := runBuild(opts.Run.Sequential.PositionalArgs.Targets, true, false); success {
+		if success, state := runBuildForRun(opts.Run.Sequential.PositionalArgs.Targets); success {
 			os.Exit(run.Sequential(state, state.ExpandOriginalTargets(), opts.Run.Sequential.Args, opts.Run.Sequential.Quiet, opts.Run.Env))
 		}
 		return false
@@ -508,9 +512,11 @@ var buildFunctions = map[string]func() bool{
 			state := core.NewBuildState(1, nil, 1, config)
 			targets = core.FindOwningPackages(state, files)
 		}
-		return runQuery(true, targets, func(state *core.BuildState) {
+		// This is done before Please stops metrics so they include the number of affected targets.
+		onBuildSuccess = func(state *core.BuildState) {
 			query.AffectedTargets(state, files.Get(), opts.BuildFlags.Include, opts.BuildFlags.Exclude, opts.Query.AffectedTargets.Tests, !opts.Query.AffectedTargets.Intransitive)
-		})
+		}
+		return runQuery(true, targets, func(state *core.BuildState) {})
 	},
 	"input": func() bool {
 		return runQuery(true, opts.Query.Input.Args.Targets, func(state *core.BuildState) {
@@ -678,6 +684,10 @@ func newCache(config *core.Configuration) core.Cache {
 	return cache.NewCache(config)
 }
 
+// onBuildSuccess is called by Please once the build has succeeded, before it stops metrics, so
+// commands can record anything else that needs to go in the final push.
+var onBuildSuccess func(state *core.BuildState)
+
 // Please starts & runs the main build process through to its completion.
 func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput, shouldBuild, shouldTest bool) (bool, *core.BuildState) {
 	if opts.BuildFlags.NumThreads > 0 {
@@ -691,6 +701,8 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	} else if debugTests {
 		config.Build.Config = "dbg"
 	}
+	config.Metrics.Tags = append(config.Metrics.Tags, opts.BuildFlags.MetricsTag...)
+	metrics.InitFromConfig(config, len(targets)) // Done before creating the cache so it can record any fallbacks.
 	c := newCache(config)
 	state := core.NewBuildState(config.Please.NumThreads, c, opts.OutputFlags.Verbosity, config)
 	state.VerifyHashes = !opts.FeatureFlags.NoHashVerification
@@ -717,7 +729,10 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	if config.Events.Port != 0 || config.Display.SystemStats {
 		go follow.UpdateResources(state)
 	}
-	metrics.InitFromConfig(config)
+	metrics.SampleQueueDepth(state.NumPending)
+	metrics.SampleMemCache(state.PathHasher.Stats)
+	metrics.RecordCacheEnabled(state.Cache != nil)
+	metrics.RecordStartup(time.Since(startTime))
 	// Acquire the lock before we start building
 	if (shouldBuild || shouldTest) && !opts.FeatureFlags.NoLock {
 		core.AcquireRepoLock()
@@ -746,6 +761,13 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	// Draw stuff to the screen while there are still results coming through.
 	shouldRun := !opts.Run.Args.Target.IsEmpty()
 	success := output.MonitorState(state, config.Please.NumThreads, !prettyOutput, opts.BuildFlags.KeepGoing, shouldBuild, shouldTest, shouldRun, opts.Build.ShowStatus, detailedTests, string(opts.OutputFlags.TraceFile))
+	if success && onBuildSuccess != nil {
+		onBuildSuccess(state)
+	}
+	if shouldBuild {
+		metrics.RecordUnusedTargets(state.Graph, state.ExpandOriginalTargets())
+		metrics.SetGraphDepth(state.Graph.Depth())
+	}
 	metrics.Stop()
 	build.StopWorkers()
 	if c != nil {
@@ -849,6 +871,15 @@ func runBuild(targets []core.BuildLabel, shouldBuild, shouldTest bool) (bool, *c
 	return Please(targets, config, pretty, shouldBuild, shouldTest)
 }
 
+// runBuildForRun builds the given targets before running them.
+func runBuildForRun(targets []core.BuildLabel) (bool, *core.BuildState) {
+	start := time.Now()
+	onBuildSuccess = func(state *core.BuildState) {
+		metrics.RecordRun(time.Since(start))
+	}
+	return runBuild(targets, true, false)
+}
+
 // readConfigAndSetRoot reads the .plzconfig files and moves to the repo root.
 func readConfigAndSetRoot(forceUpdate bool) *core.Configuration {
 	if opts.BuildFlags.RepoRoot == "" {
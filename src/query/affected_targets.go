@@ -2,6 +2,7 @@ package query
 
 import "core"
 import "fmt"
+import "metrics"
 
 // AffectedTargets walks over the build graph and identifies all targets that have a transitive
 // dependency on the given set of files.
@@ -66,6 +67,7 @@ func AffectedTargets(state *core.BuildState, files, include, exclude []string, t
 
 func handleAffectedTargets(state *core.BuildState, affectedTargets <-chan *core.BuildTarget, done chan<- bool, include, exclude []string, tests, transitive bool) {
 	seenTargets := map[*core.BuildTarget]bool{}
+	numAffected := 0
 
 	var inner func(*core.BuildTarget)
 	inner = func(target *core.BuildTarget) {
@@ -78,11 +80,13 @@ func handleAffectedTargets(state *core.BuildState, affectedTargets <-chan *core.
 			}
 			if (!tests || target.IsTest) && state.ShouldInclude(target) {
 				fmt.Printf("%s\n", target.Label)
+				numAffected++
 			}
 		}
 	}
 	for target := range affectedTargets {
 		inner(target)
 	}
+	metrics.SetAffectedTargets(numAffected)
 	done <- true
 }
@@ -162,6 +162,18 @@ func CountCoverage(lines []core.LineCoverage) (int, int) {
 	return covered, total
 }
 
+// countTotalCoverage counts the number of lines covered and coverable across all files in a coverage object.
+func countTotalCoverage(coverage core.TestCoverage) (int, int) {
+	totalCovered := 0
+	totalCoverable := 0
+	for _, lines := range coverage.Files {
+		covered, total := CountCoverage(lines)
+		totalCovered += covered
+		totalCoverable += total
+	}
+	return totalCovered, totalCoverable
+}
+
 func getStats(coverage core.TestCoverage) stats {
 	stats := stats{CoverageByFile: map[string]float32{}}
 	totalLinesCovered := 0
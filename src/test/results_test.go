@@ -84,6 +84,7 @@ func TestKarmaXML(t *testing.T) {
 	assert.Equal(t, 0, results.Failed)
 	assert.Equal(t, 0, results.Skipped)
 	assert.Equal(t, 0, results.ExpectedFailures)
+	assert.Equal(t, "PhantomJS 2.0.0 (Linux 0.0.0).services_StorageService", results.Results[0].ClassName)
 }
 
 func TestUnitTestXML(t *testing.T) {
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/op/go-logging.v1"
@@ -22,12 +23,18 @@ var log = logging.MustGetLogger("test")
 const dummyOutput = "=== RUN DummyTest\n--- PASS: DummyTest (0.00s)\nPASS\n"
 const dummyCoverage = "<?xml version=\"1.0\" ?><coverage></coverage>"
 
+// numRunning is the number of tests that are currently running.
+var numRunning int64
+
 // Test runs the tests for a single target.
 func Test(tid int, state *core.BuildState, label core.BuildLabel) {
 	state.LogBuildResult(tid, label, core.TargetTesting, "Testing...")
 	startTime := time.Now()
 	target := state.Graph.TargetOrDie(label)
+	metrics.RecordStart(target, true)
+	metrics.RecordTestConcurrency(state.Config.Please.NumThreads, int(atomic.AddInt64(&numRunning, 1)))
 	test(tid, state.ForTarget(target), label, target)
+	metrics.RecordTestConcurrency(state.Config.Please.NumThreads, int(atomic.AddInt64(&numRunning, -1)))
 	metrics.Record(target, time.Since(startTime))
 }
 
@@ -301,7 +308,10 @@ func testCommandAndEnv(state *core.BuildState, target *core.BuildTarget) (string
 func runTest(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
 	replacedCmd, env := testCommandAndEnv(state, target)
 	log.Debug("Running test %s\nENVIRONMENT:\n%s\n%s", target.Label, strings.Join(env, "\n"), replacedCmd)
-	_, out, err := core.ExecWithTimeoutShellStdStreams(state, target, target.TestDir(), env, target.TestTimeout, state.Config.Test.Timeout, state.ShowAllOutput, replacedCmd, target.TestSandbox, state.DebugTests)
+	_, out, err := core.ExecWithTimeoutShellStdStreams(state, target, target.TestDir(), env, target.TestTimeout, state.Config.Test.Timeout, state.ShowAllOutput, replacedCmd, target.TestSandbox, state.DebugTests, true)
+	if core.FDStatsAvailable {
+		metrics.RecordFDs(target, target.FDHighWater)
+	}
 	return out, err
 }
 
@@ -320,6 +330,7 @@ func parseCoverageFile(target *core.BuildTarget, coverageFile string) core.TestC
 	if err != nil {
 		log.Errorf("Failed to parse coverage file for %s: %s", target.Label, err)
 	}
+	target.Results.CoveredLines, target.Results.CoverableLines = countTotalCoverage(coverage)
 	return coverage
 }
 
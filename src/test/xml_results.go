@@ -50,6 +50,7 @@ func appendResult(test jUnitXMLTest, results *core.TestResults) {
 		results.Skipped++
 		results.Results = append(results.Results, core.TestResult{
 			Name:      test.Name,
+			ClassName: test.ClassName,
 			Skipped:   true,
 			Type:      test.Skipped.Type,
 			Traceback: test.Skipped.Message,
@@ -57,9 +58,10 @@ func appendResult(test jUnitXMLTest, results *core.TestResults) {
 	} else {
 		results.Passed++
 		results.Results = append(results.Results, core.TestResult{
-			Name:     test.Name,
-			Success:  true,
-			Duration: test.Duration(),
+			Name:      test.Name,
+			ClassName: test.ClassName,
+			Success:   true,
+			Duration:  test.Duration(),
 		})
 	}
 }
@@ -68,6 +70,7 @@ func appendResult2(test jUnitXMLTest, results *core.TestResults, failure jUnitXM
 	results.Failed++
 	results.Results = append(results.Results, core.TestResult{
 		Name:      combineNames(test.ClassName, test.Name),
+		ClassName: test.ClassName,
 		Type:      failure.Type,
 		Traceback: messageOrTraceback(failure), // TODO(pebers): store both of these, not just one.
 		Stdout:    test.Stdout,